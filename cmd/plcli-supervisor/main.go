@@ -0,0 +1,97 @@
+// plcli-supervisor runs an app instance on a node, restarting it according to its restart policy, rotating its log
+// and serving a control socket that plcli talks to over ssh. plcli builds it statically and uploads it to nodes of
+// deployments that configure a supervisor in .plcli.yml.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/supervisor"
+)
+
+const usage = `usage:
+  plcli-supervisor run -socket PATH -log PATH [-restart on-failure] [-backoff 1s] [-max-backoff 1m]
+                       [-max-log-size BYTES] [-max-log-files N] -- CMD [ARGS..]
+  plcli-supervisor ctl -socket PATH [-grace 10s] [-lines 20] status|stop|restart|logs`
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	conf := supervisor.Config{}
+	flags.StringVar(&conf.Socket, "socket", "", "path of the control socket")
+	flags.StringVar(&conf.LogPath, "log", "", "path of the log of the process")
+	flags.StringVar(&conf.Restart, "restart", supervisor.RestartOnFailure, "restart policy, never, on-failure or always")
+	flags.DurationVar(&conf.Backoff, "backoff", time.Second, "time to wait before the first restart, doubled on every restart")
+	flags.DurationVar(&conf.MaxBackoff, "max-backoff", time.Minute, "maximum time to wait before a restart")
+	flags.Int64Var(&conf.MaxLogSize, "max-log-size", 10*1024*1024, "size in bytes at which the log is rotated, 0 to disable")
+	flags.IntVar(&conf.MaxLogFiles, "max-log-files", 5, "number of rotated logs to keep")
+	flags.Parse(args)
+
+	conf.Cmd = flags.Args()
+	if conf.Socket == "" || conf.LogPath == "" {
+		return fmt.Errorf("-socket and -log are required\n%s", usage)
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	conf.Dir = dir
+
+	s, err := supervisor.New(conf)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		<-signals
+		s.Stop(time.Second * 10)
+	}()
+
+	return s.Run()
+}
+
+func ctl(args []string) error {
+	flags := flag.NewFlagSet("ctl", flag.ExitOnError)
+	socket := flags.String("socket", "", "path of the control socket")
+	grace := flags.Duration("grace", time.Second*10, "time to wait for the process to exit on stop and restart before killing it")
+	lines := flags.Int("lines", 20, "number of log lines to return")
+	flags.Parse(args)
+
+	if *socket == "" || flags.NArg() != 1 {
+		return fmt.Errorf("-socket and a command are required\n%s", usage)
+	}
+
+	resp, err := supervisor.Call(*socket, supervisor.Request{Cmd: flags.Arg(0), Grace: *grace, Lines: *lines})
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(os.Stdout).Encode(resp)
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags)
+	if len(os.Args) < 2 {
+		log.Fatal(usage)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = run(os.Args[2:])
+	case "ctl":
+		err = ctl(os.Args[2:])
+	default:
+		err = fmt.Errorf("unknown command %s\n%s", os.Args[1], usage)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
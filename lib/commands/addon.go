@@ -0,0 +1,495 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib"
+	"github.com/axelniklasson/plcli/lib/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+// directory in the plcli data dir holding user defined addons, one yml file per addon
+const addonsDir = "addons"
+
+// time an addon has to pass its probe after being started
+const (
+	addonProbeTimeout  = time.Second * 30
+	addonProbeInterval = time.Second * 2
+)
+
+// addon is a tool installed and run on nodes next to the app, in ~/addons/NAME/VERSION. The file at url, or the
+// local file uploaded instead, is verified against its sha256 checksum, given for all archs, per arch or in a
+// checksums file, and the install commands run with it in $ADDON_FILE. Start is run and restarted whenever it
+// exits by a supervisor, and probe has to succeed once it has been started. url, checksums_url, start and probe
+// are Go text/templates of the name, version, arch and port of the addon.
+type addon struct {
+	Name         string            `yaml:"name" json:"name"`
+	Version      string            `yaml:"version" json:"version,omitempty"`
+	URL          string            `yaml:"url" json:"url,omitempty"`
+	File         string            `yaml:"file" json:"file,omitempty"`
+	Checksum     string            `yaml:"checksum" json:"checksum,omitempty"`
+	Checksums    map[string]string `yaml:"checksums" json:"checksums,omitempty"`
+	ChecksumsURL string            `yaml:"checksums_url" json:"checksums_url,omitempty"`
+	Install      string            `yaml:"install" json:"install,omitempty"`
+	Start        string            `yaml:"start" json:"start,omitempty"`
+	Probe        string            `yaml:"probe" json:"probe,omitempty"`
+	Port         int               `yaml:"port" json:"port,omitempty"`
+	Metrics      bool              `yaml:"metrics" json:"metrics,omitempty"`
+	Sudo         bool              `yaml:"sudo" json:"sudo,omitempty"`
+}
+
+// addonData is what the templates of an addon are rendered with
+type addonData struct {
+	Name    string
+	Version string
+	Arch    string
+	Port    int
+}
+
+// archs of nodes by the machine reported by uname -m, named as in the release files of most tools
+var unameArchs = map[string]string{
+	"x86_64":  "amd64",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"armv7l":  "armv7",
+	"armv6l":  "armv6",
+}
+
+// checksums files fetched for addons, by url and file name
+var (
+	addonChecksums    = map[string]map[string]string{}
+	addonChecksumsMux sync.Mutex
+)
+
+// override returns the addon with the fields set in o replacing its own
+func (a addon) override(o addon) addon {
+	if o.Version != "" {
+		a.Version = o.Version
+	}
+	if o.URL != "" {
+		a.URL = o.URL
+	}
+	if o.File != "" {
+		a.File = o.File
+	}
+	if o.Checksum != "" {
+		a.Checksum = o.Checksum
+	}
+	if o.Checksums != nil {
+		a.Checksums = o.Checksums
+	}
+	if o.ChecksumsURL != "" {
+		a.ChecksumsURL = o.ChecksumsURL
+	}
+	if o.Install != "" {
+		a.Install = o.Install
+	}
+	if o.Start != "" {
+		a.Start = o.Start
+	}
+	if o.Probe != "" {
+		a.Probe = o.Probe
+	}
+	if o.Port != 0 {
+		a.Port = o.Port
+	}
+	a.Metrics = a.Metrics || o.Metrics
+	a.Sudo = a.Sudo || o.Sudo
+	return a
+}
+
+// check returns the errors in the definition of an addon
+func (a addon) check() []string {
+	errs := []string{}
+	if a.Name == "" {
+		return append(errs, "addon has no name")
+	}
+	if a.Install == "" && a.Start == "" {
+		errs = append(errs, fmt.Sprintf("addon %s has neither install nor start", a.Name))
+	}
+	if a.URL != "" && a.File != "" {
+		errs = append(errs, fmt.Sprintf("addon %s can't have both url and file", a.Name))
+	}
+	if a.URL != "" && a.Checksum == "" && a.Checksums == nil && a.ChecksumsURL == "" {
+		errs = append(errs, fmt.Sprintf("addon %s has no checksum, checksums or checksums_url for its url", a.Name))
+	}
+	if a.Port < 0 || a.Port > 65535 {
+		errs = append(errs, fmt.Sprintf("port of addon %s must be between 1 and 65535", a.Name))
+	}
+	if a.Metrics && a.Port == 0 {
+		errs = append(errs, fmt.Sprintf("addon %s exposes metrics but has no port", a.Name))
+	}
+	for field, t := range map[string]string{"url": a.URL, "checksums_url": a.ChecksumsURL, "start": a.Start, "probe": a.Probe} {
+		if _, err := template.New(field).Option("missingkey=error").Parse(t); err != nil {
+			errs = append(errs, fmt.Sprintf("%s of addon %s: %v", field, a.Name, err))
+		}
+	}
+	sort.Strings(errs)
+	return errs
+}
+
+// render renders a template of the addon for a node of arch
+func (a addon) render(t string, arch string) (string, error) {
+	tmpl, err := template.New(a.Name).Option("missingkey=error").Parse(t)
+	if err != nil {
+		return "", err
+	}
+	buf := bytes.Buffer{}
+	err = tmpl.Execute(&buf, addonData{a.Name, a.Version, arch, a.Port})
+	return buf.String(), err
+}
+
+// loadAddonFile reads the definition of an addon from a yml file
+func loadAddonFile(path string) (addon, error) {
+	a := addon{}
+	f, err := os.Open(path)
+	if err != nil {
+		return a, err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&a); err != nil {
+		return a, fmt.Errorf("Malformed addon %s: %v", path, err)
+	}
+	return a, nil
+}
+
+// knownAddons returns the built-in addons in lib/addons and the user defined addons in the plcli data dir by name,
+// user defined addons replacing built-ins of the same name
+func knownAddons() (map[string]addon, error) {
+	dataDir, err := util.DataDirPath()
+	if err != nil {
+		return nil, err
+	}
+
+	addons := map[string]addon{}
+	for _, dir := range []string{filepath.Join(lib.BasePath, "addons"), filepath.Join(dataDir, addonsDir)} {
+		files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			a, err := loadAddonFile(f)
+			if err != nil {
+				return nil, err
+			}
+			if a.Name == "" {
+				a.Name = strings.TrimSuffix(filepath.Base(f), ".yml")
+			}
+			addons[a.Name] = a
+		}
+	}
+	return addons, nil
+}
+
+// resolveAddons returns the addons enabled in .plcli.yml and by options, in that order. Entries in .plcli.yml
+// named after a known addon override its fields, --node-exporter enables the node_exporter addon and the
+// --node-exporter-* flags override its version, checksum and file.
+func resolveAddons(confAddons []addon, options *util.Options) ([]addon, error) {
+	known, err := knownAddons()
+	if err != nil {
+		return nil, err
+	}
+
+	addons := []addon{}
+	enabled := map[string]bool{}
+	for _, a := range confAddons {
+		if base, ok := known[a.Name]; ok {
+			a = base.override(a)
+		}
+		addons = append(addons, a)
+		enabled[a.Name] = true
+	}
+
+	names := options.Addons
+	if options.NodeExporter {
+		names = append(names, "node_exporter")
+	}
+	for _, name := range names {
+		if enabled[name] {
+			continue
+		}
+		a, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown addon %s, add it as %s/%s/%s.yml", name, lib.DataDir, addonsDir, name)
+		}
+		addons = append(addons, a)
+		enabled[name] = true
+	}
+
+	for i, a := range addons {
+		if a.Name == "node_exporter" {
+			addons[i] = a.override(addon{Version: options.NodeExporterVersion, Checksum: options.NodeExporterSHA256, File: options.NodeExporterTarball})
+			if options.NodeExporterTarball != "" {
+				addons[i].URL = ""
+			}
+		}
+		if errs := addons[i].check(); len(errs) > 0 {
+			return nil, errors.New(strings.Join(errs, ", "))
+		}
+	}
+	return addons, nil
+}
+
+// validateAddons checks the addons section of a .plcli.yml for errors
+func validateAddons(addons []addon, add func(msg string, path ...interface{})) {
+	known, err := knownAddons()
+	if err != nil {
+		add(fmt.Sprintf("addons can't be loaded: %v", err), "addons")
+		return
+	}
+
+	names := map[string]bool{}
+	for i, a := range addons {
+		if names[a.Name] {
+			add(fmt.Sprintf("addon %s is enabled more than once", a.Name), "addons", i, "name")
+		}
+		names[a.Name] = true
+		if base, ok := known[a.Name]; ok {
+			a = base.override(a)
+		}
+		for _, e := range a.check() {
+			add(e, "addons", i)
+		}
+	}
+}
+
+// fetchChecksum returns the sha256 checksum of file from a checksums file in the format of sha256sum, which is
+// fetched once per url
+func fetchChecksum(url string, file string) (string, error) {
+	addonChecksumsMux.Lock()
+	defer addonChecksumsMux.Unlock()
+
+	if _, ok := addonChecksums[url]; !ok {
+		resp, err := http.Get(url)
+		if err != nil {
+			return "", fmt.Errorf("Could not fetch checksums from %s: %v", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Could not fetch checksums from %s: %s", url, resp.Status)
+		}
+
+		sums := map[string]string{}
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 2 {
+				sums[strings.TrimPrefix(fields[1], "*")] = fields[0]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return "", err
+		}
+		addonChecksums[url] = sums
+	}
+
+	sum, ok := addonChecksums[url][file]
+	if !ok {
+		return "", fmt.Errorf("%s has no checksum for %s", url, file)
+	}
+	return sum, nil
+}
+
+// nodeArch detects the architecture of a node
+func nodeArch(sliceName string, hostname string) (string, error) {
+	out, err := ExecCmdOnNodeWithOutput(sliceName, hostname, "uname -m")
+	if err != nil {
+		return "", err
+	}
+	arch, ok := unameArchs[strings.TrimSpace(out)]
+	if !ok {
+		return "", fmt.Errorf("Machine %s of node %s is not supported", strings.TrimSpace(out), hostname)
+	}
+	return arch, nil
+}
+
+// addonChecksum returns the checksum the file of an addon is verified against on a node of arch
+func addonChecksum(a addon, file string, arch string) (string, error) {
+	if a.Checksum != "" {
+		return a.Checksum, nil
+	}
+	if sum, ok := a.Checksums[arch]; ok {
+		return sum, nil
+	}
+	if a.ChecksumsURL != "" {
+		url, err := a.render(a.ChecksumsURL, arch)
+		if err != nil {
+			return "", err
+		}
+		return fetchChecksum(url, file)
+	}
+	if a.File != "" {
+		return fileChecksum(a.File)
+	}
+	return "", fmt.Errorf("Addon %s has no checksum for %s", a.Name, arch)
+}
+
+// transferScript writes a script to a temporary file and transfers it to path on a node
+func transferScript(sliceName string, hostname string, script string, path string) error {
+	f, err := ioutil.TempFile("", "plcli-addon-*.sh")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(script)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return Transfer(sliceName, hostname, f.Name(), path)
+}
+
+// dirs returns the dir of an addon and of its version on nodes, relative to the home dir
+func (a addon) dirs() (string, string) {
+	version := a.Version
+	if version == "" {
+		version = "current"
+	}
+	base := fmt.Sprintf("addons/%s", a.Name)
+	return base, fmt.Sprintf("%s/%s", base, version)
+}
+
+// installScript builds the script installing an addon on a node of arch unless its version is installed already,
+// and returns it with the name of the file it verifies and installs from, if any
+func (a addon) installScript(arch string) (string, string, error) {
+	base, dir := a.dirs()
+	url, err := a.render(a.URL, arch)
+	if err != nil {
+		return "", "", err
+	}
+	file := path.Base(url)
+	if a.File != "" {
+		file = filepath.Base(a.File)
+	}
+
+	script := fmt.Sprintf("set -e\nmkdir -p \"$HOME/%s\"\ncd \"$HOME/%s\"\n", dir, base)
+	cleanup := ""
+	if url != "" || a.File != "" {
+		cleanup = fmt.Sprintf("rm -f %s; ", util.ShellQuote(file))
+	}
+	script += fmt.Sprintf("if [ -f \"$HOME/%s/.installed\" ]; then %sexit 0; fi\n", dir, cleanup)
+	if cleanup != "" {
+		checksum, err := addonChecksum(a, file, arch)
+		if err != nil {
+			return "", "", err
+		}
+		if url != "" {
+			script += fmt.Sprintf("curl -fsSL -o %s %s || wget -q -O %s %s\n", util.ShellQuote(file), util.ShellQuote(url), util.ShellQuote(file), util.ShellQuote(url))
+		}
+		script += fmt.Sprintf("echo %s | sha256sum -c - > /dev/null\n", util.ShellQuote(fmt.Sprintf("%s  %s", checksum, file)))
+		script += fmt.Sprintf("export ADDON_FILE=\"$HOME/%s/\"%s\n", base, util.ShellQuote(file))
+	}
+	script += fmt.Sprintf("export ADDON_NAME=%s ADDON_VERSION=%s ADDON_ARCH=%s\ncd \"$HOME/%s\"\n%s\ntouch .installed\n",
+		util.ShellQuote(a.Name), util.ShellQuote(a.Version), arch, dir, a.Install)
+	if cleanup != "" {
+		script += "rm -f \"$ADDON_FILE\"\n"
+	}
+	return script, file, nil
+}
+
+// installAddon installs an addon on a node unless its version is installed already, starts it supervised and
+// waits for its probe to pass
+func installAddon(sliceName string, hostname string, a addon) error {
+	arch, err := nodeArch(sliceName, hostname)
+	if err != nil {
+		return err
+	}
+	base, dir := a.dirs()
+	script, file, err := a.installScript(arch)
+	if err != nil {
+		return err
+	}
+
+	if err := ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("mkdir -p %s", base), false); err != nil {
+		return err
+	}
+	if a.File != "" {
+		if err := Transfer(sliceName, hostname, a.File, fmt.Sprintf("%s/%s", base, file)); err != nil {
+			return err
+		}
+	}
+	if err := transferScript(sliceName, hostname, script, fmt.Sprintf("%s/install.sh", base)); err != nil {
+		return err
+	}
+	sudo := ""
+	if a.Sudo {
+		sudo = "sudo "
+	}
+	if err := ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("cd %s && %ssh install.sh", base, sudo), false); err != nil {
+		return fmt.Errorf("Installing addon %s on %s failed: %v", a.Name, hostname, err)
+	}
+
+	if a.Start == "" {
+		log.Printf("Addon %s installed on %s", a.Name, hostname)
+		return nil
+	}
+
+	start, err := a.render(a.Start, arch)
+	if err != nil {
+		return err
+	}
+	run := fmt.Sprintf("cd \"$HOME/%s\" && exec %s\n", dir, start)
+	if err := transferScript(sliceName, hostname, run, fmt.Sprintf("%s/run.sh", base)); err != nil {
+		return err
+	}
+	if err := Transfer(sliceName, hostname, fmt.Sprintf("%s/scripts/supervise.sh", lib.BasePath), fmt.Sprintf("%s/supervise.sh", base)); err != nil {
+		return err
+	}
+
+	// the supervisor runs in its own process group, which is stopped along with the addon on reinstalls
+	cmd := fmt.Sprintf("cd %s && { %skill -- -$(cat supervisor.pid 2>/dev/null) 2>/dev/null; mkdir -p ~/logs; "+
+		"%ssetsid nohup sh supervise.sh \"$HOME/%s\" > ~/logs/%s.log 2>&1 < /dev/null & }", base, sudo, sudo, base, a.Name)
+	if err := ExecCmdOnNode(sliceName, hostname, cmd, false); err != nil {
+		return err
+	}
+
+	if a.Probe != "" {
+		probe, err := a.render(a.Probe, arch)
+		if err != nil {
+			return err
+		}
+		deadline := time.Now().Add(addonProbeTimeout)
+		for {
+			_, err := ExecCmdOnNodeWithOutput(sliceName, hostname, fmt.Sprintf("cd %s && %s", dir, probe))
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Addon %s on %s not healthy after %s: %v", a.Name, hostname, addonProbeTimeout, err)
+			}
+			time.Sleep(addonProbeInterval)
+		}
+	}
+
+	log.Printf("Addon %s %s for %s running on %s", a.Name, a.Version, arch, hostname)
+	return nil
+}
+
+// installAddons installs addons on a node one after another
+func installAddons(sliceName string, hostname string, addons []addon) error {
+	for _, a := range addons {
+		if err := installAddon(sliceName, hostname, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
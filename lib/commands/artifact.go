@@ -0,0 +1,126 @@
+package commands
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// directory in the plcli data dir holding the archives of apps deployed from a local directory or archive, named by
+// their sha256 checksum so that failed deployments can be resumed or rolled back to later on
+const artifactsDir = "artifacts"
+
+// fileChecksum returns the hex encoded sha256 checksum of a file
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// prepareArchive stores the app at options.FromDir or options.FromArchive as a gzipped tarball in the plcli data dir
+// and returns its path and checksum
+func prepareArchive(options *util.Options) (string, string, error) {
+	if options.FromDir != "" && options.FromArchive != "" {
+		return "", "", errors.New("Use either --from-dir or --from-archive, not both")
+	}
+
+	dataDir, err := util.DataDirPath()
+	if err != nil {
+		return "", "", err
+	}
+	dir := filepath.Join(dataDir, artifactsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", "", err
+	}
+
+	src := options.FromArchive
+	if options.FromDir != "" {
+		f, err := ioutil.TempFile(dir, "tmp-*.tar.gz")
+		if err != nil {
+			return "", "", err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		out, err := exec.Command("tar", "czf", f.Name(), "--exclude=./.git", "-C", options.FromDir, ".").CombinedOutput()
+		if err != nil {
+			return "", "", fmt.Errorf("Could not archive %s: %v\n%s", options.FromDir, err, out)
+		}
+		src = f.Name()
+	}
+
+	checksum, err := fileChecksum(src)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := filepath.Join(dir, fmt.Sprintf("%s.tar.gz", checksum))
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return "", "", err
+		}
+		if err := util.WriteFileAtomic(path, data, 0644); err != nil {
+			return "", "", err
+		}
+	}
+
+	log.Printf("Archived app with sha256 %s to %s", checksum, path)
+	return path, checksum, nil
+}
+
+// parseArchiveYML extracts an app archive to a temporary dir and parses its .plcli.yml
+func parseArchiveYML(archive string) *plcliYmlFile {
+	dir, err := ioutil.TempDir("", "plcli")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out, err := exec.Command("tar", "xzf", archive, "-C", dir).CombinedOutput()
+	if err != nil {
+		log.Fatalf("Could not extract %s: %v\n%s", archive, err, out)
+	}
+
+	conf, errs, err := loadYML(filepath.Join(dir, plcliYmlFileName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("%s: %s", plcliYmlFileName, e)
+		}
+		log.Fatalf("%s in %s has %d errors", plcliYmlFileName, archive, len(errs))
+	}
+
+	return conf
+}
+
+// uploadArchive transfers an app archive to a node and returns the command that verifies its checksum and
+// extracts it to appPath
+func uploadArchive(sliceName string, hostname string, archive string, checksum string, appPath string) (string, error) {
+	remote := fmt.Sprintf("plcli_%s.tar.gz", checksum)
+	if err := Transfer(sliceName, hostname, archive, remote); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("cd && echo '%s  %s' | sha256sum -c - > /dev/null && mkdir -p %s && tar xzf %s -C %s && rm %s",
+		checksum, remote, appPath, remote, appPath, remote), nil
+}
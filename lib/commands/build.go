@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// build describes what plcli builds locally before a deployment and distributes to all nodes
+type build struct {
+	Go *goBuild `yaml:"go"`
+}
+
+// goBuild is a Go package cross-compiled into a static binary, which is placed at Output in the app dir on nodes
+type goBuild struct {
+	Package string   `yaml:"package"`
+	GOOS    string   `yaml:"goos"`
+	GOARCH  string   `yaml:"goarch"`
+	Output  string   `yaml:"output"`
+	Flags   []string `yaml:"flags"`
+}
+
+// deployedBinary is a binary built locally for a deployment, stored in the plcli data dir by its checksum
+type deployedBinary struct {
+	Path     string `json:"path"`
+	Checksum string `json:"checksum"`
+	Output   string `json:"output"`
+}
+
+// elf machine of the binaries built for each supported GOARCH
+var goarchMachines = map[string]elf.Machine{
+	"386":   elf.EM_386,
+	"amd64": elf.EM_X86_64,
+	"arm":   elf.EM_ARM,
+	"arm64": elf.EM_AARCH64,
+}
+
+// withDefaults fills in the target and output of a build that leaves them out, given the dir of the app source. The
+// output defaults to the name of the package dir, or to the last element of the module path for the module root.
+func (b goBuild) withDefaults(dir string) goBuild {
+	if b.GOOS == "" {
+		b.GOOS = "linux"
+	}
+	if b.GOARCH == "" {
+		b.GOARCH = "amd64"
+	}
+	if b.Output == "" {
+		b.Output = filepath.Base(filepath.Clean(b.Package))
+		if b.Output == "." || b.Output == ".." || b.Output == "/" {
+			b.Output = moduleName(filepath.Join(dir, b.Package))
+		}
+	}
+	return b
+}
+
+// moduleName returns the last element of the module path in the go.mod of dir, or of dir itself if it has no go.mod
+func moduleName(dir string) string {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "go.mod"))
+	if err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "module" {
+				return path.Base(strings.Trim(fields[1], `"`))
+			}
+		}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "app"
+	}
+	return filepath.Base(filepath.Clean(abs))
+}
+
+// validate checks a build section for errors
+func (b *build) validate(dir string, add func(msg string, path ...interface{})) {
+	if b == nil || b.Go == nil {
+		return
+	}
+
+	g := b.Go.withDefaults(dir)
+	if g.Package == "" {
+		add("go build has no package", "build", "go")
+	}
+	if g.GOOS != "linux" {
+		add(fmt.Sprintf("goos %s is not supported, PlanetLab nodes run linux", g.GOOS), "build", "go", "goos")
+	}
+	if _, ok := goarchMachines[g.GOARCH]; !ok {
+		add(fmt.Sprintf("goarch %s is not supported", g.GOARCH), "build", "go", "goarch")
+	}
+	if out := filepath.Clean(g.Output); filepath.IsAbs(out) || out == "." || out == ".." || strings.HasPrefix(out, "../") {
+		add("output must be a file path within the app dir", "build", "go", "output")
+	}
+}
+
+// appSourceDir makes the source of the app of a deployment available in a temporary dir, which the returned
+// function removes
+func appSourceDir(m *deploymentManifest) (string, func(), error) {
+	dir, err := ioutil.TempDir("", "plcli")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	cmd := exec.Command("sh", "-c", fmt.Sprintf("git clone %s %s && git -C %s checkout %s", m.GitURL, dir, dir, m.Commit))
+	if m.Archive != "" {
+		cmd = exec.Command("tar", "xzf", m.Archive, "-C", dir)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("Could not get the source of the app: %v\n%s", err, out)
+	}
+
+	return dir, cleanup, nil
+}
+
+// verifyBinary checks that the file at path is a statically linked executable for goarch
+func verifyBinary(path string, goarch string) error {
+	f, err := elf.Open(path)
+	if err != nil {
+		return fmt.Errorf("%s is not an ELF binary: %v", path, err)
+	}
+	defer f.Close()
+
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return fmt.Errorf("%s is not an executable", path)
+	}
+	if f.Machine != goarchMachines[goarch] {
+		return fmt.Errorf("%s is built for %s, not %s", path, f.Machine, goarch)
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_INTERP {
+			return fmt.Errorf("%s is dynamically linked", path)
+		}
+	}
+
+	return nil
+}
+
+// buildApp builds the binary described in the build section of the app of a deployment, verifies it and stores it
+// in the plcli data dir. Returns nil if there is nothing to build.
+func buildApp(m *deploymentManifest, b *build) (*deployedBinary, error) {
+	if b == nil || b.Go == nil {
+		return nil, nil
+	}
+	src, cleanup, err := appSourceDir(m)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	g := b.Go.withDefaults(src)
+
+	out := filepath.Join(src, ".plcli-build")
+	args := append([]string{"build", "-o", out}, g.Flags...)
+	cmd := exec.Command("go", append(args, g.Package)...)
+	cmd.Dir = src
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", fmt.Sprintf("GOOS=%s", g.GOOS), fmt.Sprintf("GOARCH=%s", g.GOARCH))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.Printf("Building %s for %s/%s", g.Package, g.GOOS, g.GOARCH)
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Building %s failed: %v", g.Package, err)
+	}
+	if err := verifyBinary(out, g.GOARCH); err != nil {
+		return nil, err
+	}
+
+	checksum, err := fileChecksum(out)
+	if err != nil {
+		return nil, err
+	}
+	dataDir, err := util.DataDirPath()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dataDir, artifactsDir, fmt.Sprintf("%s.bin", checksum))
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	if err := util.WriteFileAtomic(path, data, 0755); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Built %s with sha256 %s", g.Package, checksum)
+	return &deployedBinary{path, checksum, g.Output}, nil
+}
+
+// uploadBinary transfers the binary of a deployment to the app dir on a node and verifies its checksum
+func uploadBinary(sliceName string, hostname string, b *deployedBinary, appPath string) error {
+	if b == nil {
+		return nil
+	}
+	if _, err := os.Stat(b.Path); err != nil {
+		return errors.New("The binary built for the deployment is gone from the plcli data dir, deploy again to rebuild it")
+	}
+
+	target := fmt.Sprintf("%s/%s", appPath, b.Output)
+	if dir := filepath.Dir(b.Output); dir != "." {
+		if err := ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("mkdir -p %s/%s", appPath, dir), false); err != nil {
+			return err
+		}
+	}
+	if err := Transfer(sliceName, hostname, b.Path, target); err != nil {
+		return err
+	}
+
+	return ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("cd && echo '%s  %s' | sha256sum -c - > /dev/null && chmod +x %s", b.Checksum, target, target), false)
+}
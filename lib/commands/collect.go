@@ -0,0 +1,261 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// collectedNode is the result of collecting the artifacts of a node
+type collectedNode struct {
+	Hostname string  `json:"hostname"`
+	NodeID   int     `json:"node_id"`
+	Role     string  `json:"role,omitempty"`
+	Files    int     `json:"files"`
+	Bytes    int64   `json:"bytes"`
+	Seconds  float64 `json:"seconds"`
+	Error    string  `json:"error,omitempty"`
+}
+
+// collectMetadata describes a collected run, written to metadata.json next to the artifacts
+type collectMetadata struct {
+	Deployment  string             `json:"deployment"`
+	Slice       string             `json:"slice"`
+	Origin      string             `json:"origin"`
+	Branch      string             `json:"branch,omitempty"`
+	Commit      string             `json:"commit,omitempty"`
+	Checksum    string             `json:"checksum,omitempty"`
+	Artifacts   []string           `json:"artifacts"`
+	DeployedAt  time.Time          `json:"deployed_at"`
+	DeployedIn  float64            `json:"deployed_in_seconds"`
+	CollectedAt time.Time          `json:"collected_at"`
+	CollectedIn float64            `json:"collected_in_seconds"`
+	Nodes       []collectedNode    `json:"nodes"`
+	Instances   []registryInstance `json:"instances"`
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// collectPaths returns the paths to collect from a node, relative to the home dir. Artifacts are relative to the
+// app path unless they are absolute or start with ~/, and may be shell globs. The instance logs, the start scripts,
+// the .plcli.yml and the peer list are always collected.
+func collectPaths(m *deploymentManifest) []string {
+	paths := []string{"logs", fmt.Sprintf("%s/start_instance_*.sh", m.AppPath), fmt.Sprintf("%s/%s", m.AppPath, plcliYmlFileName)}
+	if m.PeerList != "" {
+		paths = append(paths, fmt.Sprintf("%s/%s", m.AppPath, m.PeerList))
+	}
+	for _, a := range m.Artifacts {
+		switch {
+		case strings.HasPrefix(a, "/"):
+			paths = append(paths, a)
+		case strings.HasPrefix(a, "~/"):
+			paths = append(paths, strings.TrimPrefix(a, "~/"))
+		default:
+			paths = append(paths, fmt.Sprintf("%s/%s", m.AppPath, a))
+		}
+	}
+	return paths
+}
+
+// collectNode streams the artifacts of a node as a gzipped tarball over ssh and extracts it to dir, which is
+// replaced
+func collectNode(m *deploymentManifest, n deploymentNode, paths []string, dir string) collectedNode {
+	start := time.Now()
+	result := collectedNode{Hostname: n.Hostname, NodeID: n.NodeID, Role: n.Role}
+	fail := func(err error) collectedNode {
+		result.Error = err.Error()
+		result.Seconds = time.Since(start).Seconds()
+		log.Printf("Collecting artifacts of node %s failed: %v", n.Hostname, err)
+		return result
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return fail(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fail(err)
+	}
+
+	connection, err := dialNode(m.Slice, n.Hostname)
+	if err != nil {
+		return fail(err)
+	}
+	defer connection.Close()
+
+	session, err := connection.NewSession()
+	if err != nil {
+		return fail(err)
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fail(err)
+	}
+	counter := &countingReader{r: stdout}
+
+	// missing paths and globs that match nothing are skipped rather than failing the whole node
+	if err := session.Start(fmt.Sprintf("cd && tar czf - --ignore-failed-read %s 2>/dev/null", strings.Join(paths, " "))); err != nil {
+		return fail(err)
+	}
+
+	extract := exec.Command("tar", "xzf", "-", "-C", dir)
+	extract.Stdin = counter
+	if out, err := extract.CombinedOutput(); err != nil {
+		// closing the session first unblocks the remote tar if it is still writing to the channel
+		session.Close()
+		session.Wait()
+		return fail(fmt.Errorf("Could not extract artifacts: %v\n%s", err, out))
+	}
+	if err := session.Wait(); err != nil {
+		return fail(err)
+	}
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			result.Files++
+		}
+		return nil
+	})
+	result.Bytes = counter.n
+	result.Seconds = time.Since(start).Seconds()
+	log.Printf("Collected %d files from node %s", result.Files, n.Hostname)
+	return result
+}
+
+// copyIfExists copies a local file into dir, doing nothing if it doesn't exist
+func copyIfExists(src string, dir string) error {
+	data, err := ioutil.ReadFile(src)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, filepath.Base(src)), data, 0644)
+}
+
+// Collect fetches the artifacts of a deployment from its nodes, lib.WorkerPoolSize at a time, into
+// <dir>/<deployment>/<hostname>, along with its manifest, the service discovery file and a metadata.json describing
+// the run and the health of its instances, where instances that couldn't be checked have unknown health and an error.
+// The run is also packed into <dir>/<deployment>.tar.gz if tarball is set.
+func Collect(deploymentID string, options *util.Options) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	runDir := filepath.Join(options.CollectDir, m.ID)
+	if err := os.MkdirAll(runDir, 0755); err != nil {
+		return err
+	}
+
+	paths := collectPaths(m)
+	log.Printf("Collecting %s from %d nodes of deployment %s to %s", strings.Join(paths, " "), len(m.Nodes), m.ID, runDir)
+
+	jobs := make(chan util.Job, len(m.Nodes))
+	results := make(chan util.JobResult, len(m.Nodes))
+	for idx := range m.Nodes {
+		jobs <- util.Job{Func: func(i interface{}) (interface{}, error) {
+			idx := i.(int)
+			return collectNode(m, m.Nodes[idx], paths, filepath.Join(runDir, m.Nodes[idx].Hostname)), nil
+		}, Args: idx}
+	}
+	close(jobs)
+
+	workerCount := lib.WorkerPoolSize
+	if len(m.Nodes) < workerCount {
+		workerCount = len(m.Nodes)
+	}
+	for i := 0; i < workerCount; i++ {
+		go util.Worker(i, jobs, results)
+	}
+
+	nodes := []collectedNode{}
+	for j := 0; j < len(m.Nodes); j++ {
+		r := <-results
+		nodes = append(nodes, r.Result.(collectedNode))
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Hostname < nodes[j].Hostname })
+
+	snapshot := snapshotDeployment(m)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(filepath.Join(runDir, "manifest.json"), manifest, 0644); err != nil {
+		return err
+	}
+	if options.PrometheusSDPath != "" {
+		if err := copyIfExists(options.PrometheusSDPath, runDir); err != nil {
+			return err
+		}
+	}
+
+	metadata := collectMetadata{
+		Deployment:  m.ID,
+		Slice:       m.Slice,
+		Origin:      m.origin(),
+		Branch:      m.Branch,
+		Commit:      m.Commit,
+		Checksum:    m.Checksum,
+		Artifacts:   paths,
+		DeployedAt:  m.StartedAt,
+		DeployedIn:  m.FinishedAt.Sub(m.StartedAt).Seconds(),
+		CollectedAt: start,
+		CollectedIn: time.Since(start).Seconds(),
+		Nodes:       nodes,
+		Instances:   snapshot.Instances,
+	}
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(filepath.Join(runDir, "metadata.json"), data, 0644); err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, n := range nodes {
+		if n.Error != "" {
+			failures++
+		}
+	}
+	log.Printf("Collected artifacts of %d/%d nodes to %s", len(nodes)-failures, len(nodes), runDir)
+
+	if options.Tarball {
+		tarball := runDir + ".tar.gz"
+		out, err := exec.Command("tar", "czf", tarball, "-C", options.CollectDir, m.ID).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Could not create %s: %v\n%s", tarball, err, out)
+		}
+		log.Printf("Packed run into %s", tarball)
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("Failed to collect artifacts of %d/%d nodes", failures, len(nodes))
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCollectPaths(t *testing.T) {
+	m := &deploymentManifest{
+		AppPath:   "app",
+		PeerList:  "conf/peers.json",
+		Artifacts: []string{"results/*.csv", "/var/log/app.log", "~/metrics.json"},
+	}
+	expected := []string{
+		"logs", "app/start_instance_*.sh", "app/.plcli.yml", "app/conf/peers.json",
+		"app/results/*.csv", "/var/log/app.log", "metrics.json",
+	}
+	if paths := collectPaths(m); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Collect paths %v, expected %v", paths, expected)
+	}
+
+	// deployments without a peer list or artifacts still get their logs and scripts collected
+	m = &deploymentManifest{AppPath: "app"}
+	if paths := collectPaths(m); !reflect.DeepEqual(paths, expected[:3]) {
+		t.Errorf("Collect paths %v, expected %v", paths, expected[:3])
+	}
+}
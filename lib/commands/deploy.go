@@ -1,86 +1,65 @@
 package commands
 
 import (
-	"bytes"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net"
 	"os"
-	"os/exec"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/axelniklasson/plcli/lib"
 	"github.com/axelniklasson/plcli/lib/pl"
 	"github.com/axelniklasson/plcli/lib/util"
-
-	"gopkg.in/yaml.v2"
 )
 
-type plcliYmlFile struct {
-	BootstrapCmds []string          `yaml:"bootstrap_cmds"`
-	Env           map[string]string `yaml:"env"`
-	LaunchCmds    []string          `yaml:"launch_cmds"`
-}
-
 type job struct {
-	Node pl.Node
-	ID   int
+	Node     pl.Node
+	ID       int
+	Instance deploymentInstance
 }
 
 type jobResult struct {
 	Node  pl.Node
+	ID    int
 	Error error
 }
 
-// checks that there is a valid .plcli.yml file in the repo at gitURL and parses it
-func parseYML(gitURL string, gitBranch string) *plcliYmlFile {
-	if !strings.HasSuffix(gitURL, ".git") {
-		log.Fatal(errors.New("Please provide a valid git url"))
-	}
+// bootstraps a node prior to application launch with the app of a deployment, either cloned from its git url at
+// its commit or extracted from its archive after uploading it, and the binary built for it
+func bootstrap(node pl.Node, m *deploymentManifest, cmds []string, options *util.Options) error {
+	log.Printf("Bootstrapping %s", node.HostName)
 
-	cmd := fmt.Sprintf("rm -rf ./tmp && git clone %s ./tmp && cd ./tmp && git checkout %s", gitURL, gitBranch)
-	_, err := exec.Command("sh", "-c", cmd).Output()
-	if err != nil {
-		log.Fatal(err)
+	cmdsToRun := []string{
+		"kill -9 -1",
+		fmt.Sprintf("cd && rm -rf logs && rm -rf %s && mkdir logs", options.AppPath),
 	}
 
-	// parse file to bytes arr, fail if not existing or other err
-	data, err := ioutil.ReadFile("./tmp/.plcli.yml")
-	if err != nil {
-		if _, err := os.Stat("./tmp/.plcli.yml"); os.IsNotExist(err) {
-			log.Fatal(errors.New("No .plcli.yml in repo"))
+	if m.Archive != "" {
+		extractCmd, err := uploadArchive(options.Slice, node.HostName, m.Archive, m.Checksum, options.AppPath)
+		if err != nil {
+			return err
 		}
-
-		log.Fatal(err)
-	}
-
-	// parse yaml to conf struct
-	conf := plcliYmlFile{}
-	err = yaml.Unmarshal([]byte(data), &conf)
-	if err != nil {
-		log.Fatal(err)
+		cmdsToRun = append(cmdsToRun, extractCmd)
+	} else {
+		cmdsToRun = append(cmdsToRun, fmt.Sprintf("cd && git clone %s %s", m.GitURL, options.AppPath))
+		cmdsToRun = append(cmdsToRun, fmt.Sprintf("cd %s && git checkout %s", options.AppPath, m.Commit))
 	}
 
-	// remove tmp dir
-	os.RemoveAll("./tmp")
-	return &conf
-}
-
-// bootstraps a node prior to application launch
-func bootstrap(node pl.Node, gitURL string, cmds []string, options *util.Options) error {
-	log.Printf("Bootstrapping %s", node.HostName)
-
-	cmdsToRun := []string{
-		"kill -9 -1",
-		fmt.Sprintf("cd && rm -rf logs && rm -rf %s && mkdir logs", options.AppPath),
-		fmt.Sprintf("cd && git clone %s %s", gitURL, options.AppPath),
+	// the binary has to be in place before the bootstrap commands run
+	if m.Binary != nil {
+		if err := ExecCmdOnNode(options.Slice, node.HostName, strings.Join(cmdsToRun, " && "), false); err != nil {
+			return err
+		}
+		if err := uploadBinary(options.Slice, node.HostName, m.Binary, options.AppPath); err != nil {
+			return err
+		}
+		cmdsToRun = []string{}
 	}
 
-	s := fmt.Sprintf("cd %s && git checkout %s", options.AppPath, options.GitBranch)
+	s := fmt.Sprintf("cd %s", options.AppPath)
 	for _, cmd := range cmds {
 		s += fmt.Sprintf(" && %s", cmd)
 	}
@@ -98,37 +77,61 @@ func bootstrap(node pl.Node, gitURL string, cmds []string, options *util.Options
 	// execute all commands chained as one
 	err := ExecCmdOnNode(options.Slice, node.HostName, cmdString, false)
 	if err != nil {
-		return nil
+		return err
 	}
 
-	if options.NodeExporter {
-		err := Transfer(options.Slice, node.HostName, fmt.Sprintf("%s/scripts/node_exporter.sh", lib.BasePath), "~/node_exporter.sh")
-		if err != nil {
-			return err
-		}
-
-		log.Println("Launching node_exporter")
-		ExecCmdOnNode(options.Slice, node.HostName, "cd ~; pkill node_exporter; chmod +x node_exporter.sh; nohup sh node_exporter.sh > ~/logs/node_exporter.log 2>&1 &", false)
-		if err != nil {
+	if m.Supervisor != nil {
+		if err := uploadSupervisor(options.Slice, node.HostName); err != nil {
 			return err
 		}
 	}
+	if err := installAddons(options.Slice, node.HostName, m.Addons); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// startInstanceCmd builds the command that starts an already written start script of an instance in the
+// background, under plcli-supervisor if s is set. The instance runs in its own process group, so that it can be
+// stopped along with any processes it spawns, and the script writes its pid to a file that plcli status/stop/restart
+// use to find unsupervised instances.
+func startInstanceCmd(appPath string, instanceID int, sudo bool, s *supervisorConfig) string {
+	prefix := ""
+	if sudo {
+		prefix = "sudo "
+	}
+	if s != nil {
+		return supervisedStartCmd(appPath, instanceID, prefix, s)
+	}
+	return fmt.Sprintf("cd %s; %ssetsid nohup sh start_instance_%d.sh ~/logs/instance_%d.pid > ~/logs/instance_%d.log 2>&1 < /dev/null &",
+		appPath, prefix, instanceID, instanceID, instanceID)
+}
+
 // launches an application on a given node
-func launch(node pl.Node, scriptString string, instanceID int, options *util.Options) error {
-	scriptString = fmt.Sprintf("export PLCLI_INSTANCE_ID=%d; ", instanceID) + scriptString
+func launch(node pl.Node, scriptString string, instanceID int, s *supervisorConfig, options *util.Options) error {
+	scriptString = "#!/bin/sh\necho $$ > \"$1\"\n" + scriptString
 
-	cmdsToRun := []string{
-		fmt.Sprintf("cd %s && echo '%s' > start_instance_%d.sh && chmod +x start_instance_%d.sh", options.AppPath, scriptString, instanceID, instanceID),
+	// the script is uploaded as a file rather than echoed on the node, so that it needs no quoting
+	f, err := ioutil.TempFile("", "plcli-start-*.sh")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(scriptString)
+	f.Close()
+	if err != nil {
+		return err
 	}
 
-	if options.Sudo {
-		cmdsToRun = append(cmdsToRun, fmt.Sprintf("cd %s; sudo nohup sh start_instance_%d.sh > ~/logs/instance_%d.log 2>&1 &", options.AppPath, instanceID, instanceID))
-	} else {
-		cmdsToRun = append(cmdsToRun, fmt.Sprintf("cd %s; nohup sh start_instance_%d.sh > ~/logs/instance_%d.log 2>&1 &", options.AppPath, instanceID, instanceID))
+	err = Transfer(options.Slice, node.HostName, f.Name(), fmt.Sprintf("%s/start_instance_%d.sh", options.AppPath, instanceID))
+	if err != nil {
+		return err
+	}
+
+	cmdsToRun := []string{
+		fmt.Sprintf("cd %s && chmod +x start_instance_%d.sh", options.AppPath, instanceID),
+		startInstanceCmd(options.AppPath, instanceID, options.Sudo, s),
 	}
 
 	cmdString := ""
@@ -140,34 +143,36 @@ func launch(node pl.Node, scriptString string, instanceID int, options *util.Opt
 		}
 	}
 
-	err := ExecCmdOnNode(options.Slice, node.HostName, cmdString, false)
+	err = ExecCmdOnNode(options.Slice, node.HostName, cmdString, false)
 	return err
 
 }
 
 // worker that takes care of bootstrapping a node prior to app launch
-func bootstrapWorker(id int, jobs <-chan pl.Node, results chan<- jobResult, gitURL string, cmds []string, options *util.Options) {
+func bootstrapWorker(id int, jobs <-chan pl.Node, results chan<- jobResult, m *deploymentManifest, cmds []string, options *util.Options) {
 	for node := range jobs {
 		log.Printf("Worker %d bootstrapping node %s", id, node.HostName)
-		bootstrapError := bootstrap(node, gitURL, cmds, options)
+		bootstrapError := bootstrap(node, m, cmds, options)
 		// write result of job back to main thread
-		results <- jobResult{node, bootstrapError}
+		results <- jobResult{Node: node, Error: bootstrapError}
 	}
 }
 
-// worker that takes care of launching app on a node
-func launchWorker(id int, jobs <-chan job, results chan<- jobResult, scriptString string, options *util.Options) {
+// worker that takes care of launching app on a node and waiting for it to be ready
+func launchWorker(id int, jobs <-chan job, results chan<- jobResult, m *deploymentManifest, conf *plcliYmlFile, options *util.Options) {
 	for job := range jobs {
 		log.Printf("Worker %d launching app instance %d on node %s", id, job.ID, job.Node.HostName)
-		launchError := launch(job.Node, scriptString, job.ID, options)
+		launchError := launch(job.Node, conf.launchScript(job.Instance, len(m.Instances), m.Env), job.ID, m.Supervisor, options)
+		if launchError == nil {
+			launchError = waitForReady(options.Slice, options.AppPath, job.Instance, conf.ReadinessProbe)
+		}
 		// write result of job back to main thread
-		results <- jobResult{job.Node, launchError}
+		results <- jobResult{Node: job.Node, ID: job.ID, Error: launchError}
 	}
 }
 
-// bootstrap nodes concurrently using workers
-// func bootstrapNodes(sliceName string, nodes []pl.Node, gitURL string, gitBranch string, cmds []string) error {
-func bootstrapNodes(nodes []pl.Node, gitURL string, cmds []string, options *util.Options) error {
+// bootstrap nodes concurrently using workers, returns the result of every node
+func bootstrapNodes(nodes []pl.Node, m *deploymentManifest, cmds []string, options *util.Options) []jobResult {
 	jobs := make(chan pl.Node, len(nodes))
 	results := make(chan jobResult, len(nodes))
 
@@ -178,7 +183,7 @@ func bootstrapNodes(nodes []pl.Node, gitURL string, cmds []string, options *util
 	}
 	i := 0
 	for i < workerCount {
-		go bootstrapWorker(i, jobs, results, gitURL, cmds, options)
+		go bootstrapWorker(i, jobs, results, m, cmds, options)
 		i++
 	}
 
@@ -188,60 +193,179 @@ func bootstrapNodes(nodes []pl.Node, gitURL string, cmds []string, options *util
 	}
 	close(jobs)
 
+	nodeResults := []jobResult{}
 	for j := 0; j < len(nodes); j++ {
 		res := <-results
 		if res.Error != nil {
-			log.Fatalf("Bootstrapping of node %s failed with errror: %v", res.Node.HostName, res.Error)
+			log.Printf("Bootstrapping of node %s failed with errror: %v", res.Node.HostName, res.Error)
 		} else {
 			log.Printf("Bootstrapping of node %s succeeded!", res.Node.HostName)
 		}
+		nodeResults = append(nodeResults, res)
 	}
 	log.Print("Bootstrapping of nodes completed")
-	return nil
+	return nodeResults
 }
 
-// launch nodes concurrently using workers
-func launchNodes(nodes []pl.Node, env map[string]string, cmds []string, options *util.Options) error {
-	instanceCount := len(nodes) * options.Scale
-	scriptString := ""
+// deploymentEnv merges env vars from .plcli.yml with the ones in --env-file and given through --env, later ones
+// taking precedence
+func deploymentEnv(env map[string]string, options *util.Options) map[string]string {
+	merged := map[string]string{}
 	for k, v := range env {
-		scriptString += fmt.Sprintf("export %s=%s; ", k, v)
+		merged[k] = v
+	}
+
+	if options.EnvFile != "" {
+		fileEnv, err := parseEnvFile(options.EnvFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for k, v := range fileEnv {
+			merged[k] = v
+		}
+	}
+
+	for _, v := range options.EnvVars {
+		k, v, err := parseEnvVar(v)
+		if err != nil {
+			log.Fatal(err)
+		}
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// parseEnvVar splits a KEY=VALUE string at its first equals sign, the value is taken as is
+func parseEnvVar(s string) (string, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !envNamePattern.MatchString(parts[0]) {
+		return "", "", fmt.Errorf("Badly formatted env var %q, should be KEY=VALUE", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// parseEnvFile reads a file with a KEY=VALUE pair on each line, skipping empty lines and lines starting with #.
+// Values wrapped in matching single or double quotes are unwrapped.
+func parseEnvFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	env := map[string]string{}
+	for idx, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		k, v, err := parseEnvVar(strings.TrimPrefix(line, "export "))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, idx+1, err)
+		}
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		env[k] = v
 	}
 
-	if options.EnvVars != "" {
-		vars := strings.Split(options.EnvVars, ",")
-		for _, v := range vars {
-			parts := strings.Split(v, "=")
-			if len(parts) != 2 {
-				log.Fatal("Badly formatted env string. Should be VAR1=VAL1,VAR2=VAL2,etc")
+	return env, nil
+}
+
+// planInstances assigns roles to the nodes of a deployment and allocates their app instances
+func planInstances(m *deploymentManifest, conf *plcliYmlFile) error {
+	roles, err := conf.assignRoles(len(m.Nodes))
+	if err != nil {
+		return err
+	}
+
+	for i := range m.Nodes {
+		m.Nodes[i].Role = roles[i]
+	}
+	return allocateInstances(m, conf)
+}
+
+// allocateInstances creates the app instances of every node of a deployment according to its role. Instances get
+// consecutive IDs in node order, which their ports are offset by.
+func allocateInstances(m *deploymentManifest, conf *plcliYmlFile) error {
+	m.Instances = []deploymentInstance{}
+	for idx, n := range m.Nodes {
+		for j := 0; j < conf.roleScale(n.Role, m.Scale); j++ {
+			id := len(m.Instances)
+			i := deploymentInstance{
+				ID:        id,
+				Hostname:  n.Hostname,
+				NodeID:    n.NodeID,
+				NodeIndex: idx,
+				Role:      n.Role,
+				Port:      conf.Port.forInstance(conf.Port.basePort(), id),
+				Ports:     map[string]int{},
+			}
+			for name, base := range conf.Ports {
+				i.Ports[name] = conf.Port.forInstance(base, id)
 			}
 
-			scriptString += fmt.Sprintf("export %s=%s; ", parts[0], parts[1])
+			for _, port := range append([]int{i.Port}, mapValues(i.Ports)...) {
+				if port > 65535 {
+					return fmt.Errorf("Instance %d would get port %d, use a lower base port or stride", id, port)
+				}
+			}
+			m.Instances = append(m.Instances, i)
 		}
 	}
+	return nil
+}
+
+// mapValues returns the values of a map of ports
+func mapValues(m map[string]int) []int {
+	values := []int{}
+	for _, v := range m {
+		values = append(values, v)
+	}
+	return values
+}
+
+// buildLaunchScript builds the script that exports env, ordered by name, and runs the launch commands of an instance
+func buildLaunchScript(env map[string]string, cmds []string) string {
+	keys := []string{}
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	scriptString := ""
+	for _, k := range keys {
+		scriptString += fmt.Sprintf("export %s=%s\n", k, util.ShellQuote(env[k]))
+	}
 
 	for _, cmd := range cmds {
-		scriptString += fmt.Sprintf("%s; ", cmd)
+		scriptString += fmt.Sprintf("%s\n", cmd)
 	}
 
-	jobs := make(chan job, len(nodes))
-	results := make(chan jobResult, len(nodes))
+	return scriptString
+}
+
+// launch instances of a deployment concurrently using workers, returns the result of every instance
+func launchNodes(m *deploymentManifest, instances []deploymentInstance, conf *plcliYmlFile, options *util.Options) []jobResult {
+	instanceCount := len(instances)
+
+	jobs := make(chan job, instanceCount)
+	results := make(chan jobResult, instanceCount)
 
 	// launch workers
 	workerCount := lib.WorkerPoolSize
 	if instanceCount < workerCount {
-		workerCount = len(nodes)
+		workerCount = instanceCount
 	}
 	for i := 0; i < workerCount; i++ {
-		go launchWorker(i, jobs, results, scriptString, options)
+		go launchWorker(i, jobs, results, m, conf, options)
 	}
 
 	// create jobs
 	jobSlice := []job{}
-	for i, n := range nodes {
-		for j := i * options.Scale; j < i*options.Scale+options.Scale; j++ {
-			jobSlice = append(jobSlice, job{Node: n, ID: i})
-		}
+	for _, i := range instances {
+		jobSlice = append(jobSlice, job{Node: pl.Node{HostName: i.Hostname, NodeID: i.NodeID}, ID: i.ID, Instance: i})
 	}
 
 	// shuffle jobs
@@ -256,62 +380,19 @@ func launchNodes(nodes []pl.Node, env map[string]string, cmds []string, options
 	close(jobs)
 
 	launches := 0
+	instanceResults := []jobResult{}
 	for j := 0; j < instanceCount; j++ {
 		res := <-results
+		instanceResults = append(instanceResults, res)
 		if res.Error != nil {
-			log.Fatalf("Instance launch on node %s failed with errror: %v", res.Node.HostName, res.Error)
+			log.Printf("Launch of instance %d on node %s failed with errror: %v", res.ID, res.Node.HostName, res.Error)
+			continue
 		}
 		launches++
 		log.Printf("%d/%d instances launched! ", launches, instanceCount)
 	}
-	log.Print("App launched on all nodes!")
-	return nil
-
-}
-
-func transferHostFile(nodes []pl.Node, options *util.Options) error {
-	buf := bytes.Buffer{}
-
-	for i, n := range nodes {
-		for j := i * options.Scale; j < i*options.Scale+options.Scale; j++ {
-			ip, err := net.LookupIP(n.HostName)
-			if err != nil {
-				return err
-			}
-
-			ipString := ""
-			for idx, x := range ip {
-				if idx < len(ip)-1 {
-					ipString += fmt.Sprintf("%s.", x)
-				} else {
-					ipString += fmt.Sprintf("%s", x)
-				}
-			}
-
-			if i == len(nodes)-1 && j == i*options.Scale+options.Scale-1 {
-				buf.WriteString(fmt.Sprintf("%d,%s,%s", j, n.HostName, ipString))
-			} else {
-				buf.WriteString(fmt.Sprintf("%d,%s,%s\n", j, n.HostName, ipString))
-			}
-		}
-	}
-
-	// transfer hosts file to all nodes
-	for _, n := range nodes {
-		err := ExecCmdOnNode(options.Slice, n.HostName, fmt.Sprintf("echo '%s' >> %s/hosts.txt", buf.String(), options.AppPath), true)
-		if err != nil {
-			return err
-		}
-	}
-
-	if !options.SkipWriteHostsFile {
-		f, _ := os.Create("./hosts_deployment.txt")
-		defer f.Close()
-
-		f.WriteString(buf.String())
-	}
-
-	return nil
+	log.Printf("Launched %d/%d instances", launches, instanceCount)
+	return instanceResults
 }
 
 func removeBlackListed(nodes []pl.Node, blacklistedHostnames []string) []pl.Node {
@@ -336,18 +417,65 @@ func removeBlackListed(nodes []pl.Node, blacklistedHostnames []string) []pl.Node
 	return okNodes
 }
 
-// Deploy performs a PlanetLab deployment of app at gitUrl on nodeCount nodes using slice sliceName
+// Deploy performs a PlanetLab deployment of app at gitUrl, or of the app in options.FromDir or options.FromArchive,
+// on nodeCount nodes using slice sliceName
 func Deploy(gitURL string, options *util.Options) error {
+	if options.Resume {
+		return resumeDeploy(options)
+	}
+	fromArtifact := options.FromDir != "" || options.FromArchive != ""
+	if fromArtifact && gitURL != "" {
+		log.Fatal("Deploy either a git url or the app given by --from-dir or --from-archive")
+	}
+	if options.Strategy == "rolling" {
+		if fromArtifact {
+			log.Fatal("Rolling deployments update nodes through git, --from-dir and --from-archive are not supported")
+		}
+		return rollingDeploy(gitURL, options)
+	} else if options.Strategy != "recreate" {
+		log.Fatalf("Unknown deployment strategy %s, should be recreate or rolling", options.Strategy)
+	}
+
 	start := time.Now()
-	log.Printf("Initiating deployment of %d instances of app %s to %d nodes using slice %s ", options.NodeCount*options.Scale, gitURL, options.NodeCount, options.Slice)
+	var conf *plcliYmlFile
+	var manifest *deploymentManifest
+	if fromArtifact {
+		archive, checksum, err := prepareArchive(options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		conf = parseArchiveYML(archive)
+		manifest = newDeploymentManifest("", "", options)
+		manifest.Source = options.FromDir + options.FromArchive
+		manifest.Archive = archive
+		manifest.Checksum = checksum
+	} else {
+		var commit string
+		conf, commit = parseYML(gitURL, options.GitBranch)
+		manifest = newDeploymentManifest(gitURL, commit, options)
+	}
+	log.Printf("Initiating deployment of %d instances of app %s to %d nodes using slice %s ", options.NodeCount*options.Scale, manifest.origin(), options.NodeCount, options.Slice)
 
-	conf := parseYML(gitURL, options.GitBranch)
+	manifest.Env = deploymentEnv(conf.Env, options)
+	manifest.LivenessProbe = conf.LivenessProbe
+	manifest.Artifacts = conf.Artifacts
+	manifest.PeerList = conf.Peers.dest()
+	addons, err := resolveAddons(conf.Addons, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifest.Addons = addons
+	manifest.Supervisor = conf.Supervisor
+	binary, err := buildApp(manifest, conf.Build)
+	if err != nil {
+		log.Fatal(err)
+	}
+	manifest.Binary = binary
 	var nodes []pl.Node
-	var err error
 
-	// possible healthcheck of nodes
+	// possible healthcheck of nodes, healthy nodes are ordered best first
 	if !options.SkipHealthCheck {
-		nodes = HealthCheck(options.Slice, false)
+		nodes = HealthCheck(options.Slice, false, "score")
 	} else {
 		log.Printf("Skipping healthcheck of nodes")
 		nodes, err = pl.GetNodesForSlice(options.Slice)
@@ -360,8 +488,19 @@ func Deploy(gitURL string, options *util.Options) error {
 		nodes = removeBlackListed(nodes, strings.Split(options.BlacklistedHostnames, ","))
 	}
 
-	if len(nodes) < options.NodeCount {
-		log.Fatal(fmt.Errorf("Could not find enough nodes.. Found %d/%d. Run health check to learn more", len(nodes), options.NodeCount))
+	if options.MinReliability > 0 {
+		nodes = removeUnreliable(nodes, options.MinReliability, options.HealthWindow)
+	}
+
+	minNodes := options.NodeCount
+	if options.MinNodes > 0 {
+		if options.MinNodes > options.NodeCount {
+			log.Fatalf("--min-nodes can't be larger than the number of nodes (%d)", options.NodeCount)
+		}
+		minNodes = options.MinNodes
+	}
+	if len(nodes) < minNodes {
+		log.Fatal(fmt.Errorf("Could not find enough nodes.. Found %d/%d. Run health check to learn more", len(nodes), minNodes))
 	}
 
 	// shuffle nodes
@@ -371,8 +510,17 @@ func Deploy(gitURL string, options *util.Options) error {
 		rand.Shuffle(len(nodes), func(i, j int) { nodes[i], nodes[j] = nodes[j], nodes[i] })
 	}
 
-	// pretty-print nodes that will be used for deployment
-	nodes = nodes[0:options.NodeCount]
+	// pretty-print nodes that will be used for deployment, the following ones are spares
+	nodeCount := options.NodeCount
+	if len(nodes) < nodeCount {
+		log.Printf("Only found %d/%d nodes, deploying to them since at least %d nodes are needed", len(nodes), nodeCount, minNodes)
+		nodeCount = len(nodes)
+	}
+	spares := nodes[nodeCount:]
+	if len(spares) > options.Spares {
+		spares = spares[:options.Spares]
+	}
+	nodes = nodes[0:nodeCount]
 	var hostnames string
 	for idx, n := range nodes {
 		hostnames += n.HostName
@@ -384,69 +532,160 @@ func Deploy(gitURL string, options *util.Options) error {
 	}
 	log.Printf("Nodes that will be used for deployment: %s\n", hostnames)
 
-	// bootstrap all nodes
-	// err = bootstrapNodes(sliceName, nodes, gitURL, gitBranch, conf.BootstrapCmds)
-	err = bootstrapNodes(nodes, gitURL, conf.BootstrapCmds, options)
+	// record the deployment before touching any node, so that it can be resumed or rolled back if it fails
+	if previous := latestDeployment(options.Slice); previous != nil {
+		manifest.PreviousID = previous.ID
+	}
+	manifest.setNodes(nodes)
+	manifest.setSpares(spares)
+	manifest.MinNodes = minNodes
+	if len(spares) > 0 {
+		log.Printf("Nodes that may replace failed nodes: %d spares", len(spares))
+	}
+	err = planInstances(manifest, conf)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// transfer hosts file to app repo
-	err = transferHostFile(nodes, options)
+	err = runHooks("pre_deploy", conf.Hooks.PreDeploy, manifest)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// launch app on all nodes
-	err = launchNodes(nodes, conf.Env, conf.LaunchCmds, options)
+	err = writeManifest(manifest)
 	if err != nil {
 		log.Fatal(err)
 	}
+	log.Printf("Deployment %s of %s recorded, run plcli status %s to inspect it", manifest.ID, manifest.version(), manifest.ID)
 
-	if options.PrometheusSDPath != "" {
-		writePromSD(nodes, options)
+	err = runDeployment(manifest, conf, options)
+	if err != nil {
+		return failDeployment(manifest, err, options)
 	}
-
-	log.Println("Deployment finished!")
-	elapsed := time.Since(start)
-	log.Printf("Deployment of %d app instances to %d nodes took %s", options.NodeCount*options.Scale, options.NodeCount, elapsed)
-	return nil
+	return finishDeployment(manifest, conf, start, options)
 }
 
-// writePromSD builds and writes an sd file for prometheus to the given path
-func writePromSD(nodes []pl.Node, options *util.Options) {
-	// remove file if exists
-	os.Remove(options.PrometheusSDPath)
+// runDeployment takes the nodes of a deployment as far as they have not come yet. Pending nodes are bootstrapped
+// and get the peer list and rendered templates, then the instances of bootstrapped nodes are launched. A node that fails to launch
+// goes back to pending, since it may run some of its instances, and is bootstrapped from scratch on resume.
+// The manifest is written after every step.
+func runDeployment(m *deploymentManifest, conf *plcliYmlFile, options *util.Options) error {
+	failed := []string{}
+	bootstrapped := []pl.Node{}
+	changed := false
+	pending := m.nodesInState(nodePending)
+	for len(pending) > 0 {
+		// nodes that fail are replaced by spare nodes, which are bootstrapped in the next round
+		replacements := []pl.Node{}
+		for _, res := range bootstrapNodes(pending, m, conf.BootstrapCmds, options) {
+			if res.Error == nil {
+				bootstrapped = append(bootstrapped, res.Node)
+				continue
+			}
 
-	// create file
-	f, err := os.Create(options.PrometheusSDPath)
-	if err != nil {
-		log.Fatalf("Could not create prom sd file: error: %v", err)
+			m.setNodeState(res.Node.HostName, nodePending, res.Error)
+			if spare, ok := m.replaceNode(res.Node.HostName); ok {
+				log.Printf("Replacing node %s with spare node %s", res.Node.HostName, spare.HostName)
+				replacements = append(replacements, spare)
+				changed = true
+			} else if len(m.Nodes) > m.MinNodes {
+				log.Printf("No spare nodes left, dropping node %s from the deployment", res.Node.HostName)
+				m.dropNode(res.Node.HostName)
+				changed = true
+			} else {
+				failed = append(failed, res.Node.HostName)
+			}
+		}
+		pending = replacements
+	}
+
+	// instances are renumbered after dropping nodes, unless some of them already run
+	if changed && len(m.nodesInState(nodeLaunched)) == 0 {
+		if err := allocateInstances(m, conf); err != nil {
+			return err
+		}
 	}
-	defer f.Close()
 
-	nodeExporterTargets := ""
-	ssurbTargets := ""
-	for i, n := range nodes {
-		for j := i * options.Scale; j < i*options.Scale+options.Scale; j++ {
-			if i == len(nodes)-1 && j == i*options.Scale+options.Scale-1 {
-				ssurbTargets += fmt.Sprintf("\"%s:%d\"", n.HostName, 2112+j)
+	// transfer peer list and templates to the app repo of freshly bootstrapped nodes, or of all nodes if the set of
+	// nodes changed
+	targets := bootstrapped
+	if changed {
+		targets = append(targets, m.nodesInState(nodeBootstrapped)...)
+		targets = append(targets, m.nodesInState(nodeLaunched)...)
+	}
+	if len(bootstrapped) > 0 {
+		err := transferPeerList(m, conf, targets, options)
+		if err != nil {
+			err = fmt.Errorf("Could not transfer peer list: %v", err)
+		} else {
+			err = renderTemplates(m, conf, targets)
+		}
+		for _, n := range bootstrapped {
+			if err != nil {
+				m.setNodeState(n.HostName, nodePending, err)
 			} else {
-				ssurbTargets += fmt.Sprintf("\"%s:%d\",", n.HostName, 2112+j)
+				m.setNodeState(n.HostName, nodeBootstrapped, nil)
 			}
 		}
-		if i == len(nodes)-1 {
-			nodeExporterTargets += fmt.Sprintf("\"%s:2100\"", n.HostName)
+		if err != nil {
+			writeManifest(m)
+			return err
+		}
+	}
+
+	if err := writeManifest(m); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Bootstrapping of nodes %v failed", failed)
+	}
+
+	// launch app on all bootstrapped nodes
+	instances := []deploymentInstance{}
+	byHostname := m.instancesByHostname()
+	for _, n := range m.nodesInState(nodeBootstrapped) {
+		instances = append(instances, byHostname[n.HostName]...)
+	}
+	launchErrors := map[string]error{}
+	for _, res := range launchNodes(m, instances, conf, options) {
+		if launchErrors[res.Node.HostName] == nil {
+			launchErrors[res.Node.HostName] = res.Error
+		}
+	}
+	for hostname, err := range launchErrors {
+		if err != nil {
+			m.setNodeState(hostname, nodePending, err)
+			failed = append(failed, hostname)
 		} else {
-			nodeExporterTargets += fmt.Sprintf("\"%s:2100\",", n.HostName)
+			m.setNodeState(hostname, nodeLaunched, nil)
 		}
 	}
 
-	sdString := fmt.Sprintf("[{\"targets\": [%s],\"labels\": { \"env\": \"planetlab\", \"job\": \"self-stabilizing-urb\" }},", ssurbTargets)
-	sdString += fmt.Sprintf("{\"targets\": [%s],\"labels\": { \"env\": \"planetlab\", \"job\": \"node_exporter\" }}]", nodeExporterTargets)
+	if err := writeManifest(m); err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Launch of instances on nodes %v failed", failed)
+	}
+	return nil
+}
+
+// finishDeployment marks a deployment with all instances launched as complete and runs its post_deploy hooks
+func finishDeployment(m *deploymentManifest, conf *plcliYmlFile, start time.Time, options *util.Options) error {
+	m.Status = deploymentComplete
+	m.FinishedAt = time.Now()
+	err := writeManifest(m)
+	if err != nil {
+		return err
+	}
 
-	// write to file
-	f.WriteString(sdString)
+	if options.PrometheusSDPath != "" {
+		if err := writeServiceDiscovery(m, conf, options); err != nil {
+			return err
+		}
+	}
 
-	log.Printf("Wrote sd.json to %s", options.PrometheusSDPath)
+	log.Println("Deployment finished!")
+	log.Printf("Deployment of %d app instances to %d nodes took %s", len(m.Instances), len(m.Nodes), time.Since(start))
+	return runHooks("post_deploy", conf.Hooks.PostDeploy, m)
 }
@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAllocateInstances(t *testing.T) {
+	stride := 10
+	conf := &plcliYmlFile{
+		Roles: []role{{Name: "server", Scale: 2}, {Name: "client"}},
+		Port:  portAllocation{Base: 3000, Stride: &stride},
+		Ports: map[string]int{"metrics": 9000},
+	}
+	m := &deploymentManifest{Scale: 1, Nodes: []deploymentNode{
+		{Hostname: "a.example.org", NodeID: 1, Role: "server"},
+		{Hostname: "b.example.org", NodeID: 2, Role: "client"},
+		{Hostname: "c.example.org", NodeID: 3},
+	}}
+	if err := allocateInstances(m, conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// IDs are consecutive in node order, roles without a scale fall back to the scale of the deployment
+	expected := []deploymentInstance{
+		{ID: 0, Hostname: "a.example.org", NodeID: 1, NodeIndex: 0, Role: "server", Port: 3000, Ports: map[string]int{"metrics": 9000}},
+		{ID: 1, Hostname: "a.example.org", NodeID: 1, NodeIndex: 0, Role: "server", Port: 3010, Ports: map[string]int{"metrics": 9010}},
+		{ID: 2, Hostname: "b.example.org", NodeID: 2, NodeIndex: 1, Role: "client", Port: 3020, Ports: map[string]int{"metrics": 9020}},
+		{ID: 3, Hostname: "c.example.org", NodeID: 3, NodeIndex: 2, Port: 3030, Ports: map[string]int{"metrics": 9030}},
+	}
+	if !reflect.DeepEqual(m.Instances, expected) {
+		t.Errorf("Allocated instances %+v, expected %+v", m.Instances, expected)
+	}
+}
+
+func TestAllocateInstancesDefaults(t *testing.T) {
+	m := &deploymentManifest{Scale: 2, Nodes: []deploymentNode{{Hostname: "a.example.org"}, {Hostname: "b.example.org"}}}
+	if err := allocateInstances(m, &plcliYmlFile{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Instances) != 4 {
+		t.Fatalf("Allocated %d instances, expected 4", len(m.Instances))
+	}
+	for idx, i := range m.Instances {
+		if i.ID != idx || i.Port != defaultBasePort+idx || i.NodeIndex != idx/2 {
+			t.Errorf("Instance %d allocated as %+v", idx, i)
+		}
+	}
+}
+
+func TestAllocateInstancesPortOverflow(t *testing.T) {
+	conf := &plcliYmlFile{Ports: map[string]int{"metrics": 65535}}
+	m := &deploymentManifest{Scale: 2, Nodes: []deploymentNode{{Hostname: "a.example.org"}}}
+	if err := allocateInstances(m, conf); err == nil {
+		t.Error("Expected an error for a port above 65535")
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	contents := strings.Join([]string{
+		"# comment",
+		"",
+		"PLAIN=value",
+		"  export EXPORTED=1",
+		`DOUBLE="two words"`,
+		`SINGLE='it''s'`,
+		`MISMATCHED="value'`,
+		"EMPTY=",
+		"URL=http://example.org/?a=b",
+	}, "\n")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := parseEnvFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"PLAIN":      "value",
+		"EXPORTED":   "1",
+		"DOUBLE":     "two words",
+		"SINGLE":     "it''s",
+		"MISMATCHED": `"value'`,
+		"EMPTY":      "",
+		"URL":        "http://example.org/?a=b",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Parsed env %v, expected %v", env, expected)
+	}
+}
+
+func TestParseEnvFileErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := ioutil.WriteFile(path, []byte("OK=1\n\nnot an env var\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := parseEnvFile(path)
+	if err == nil || !strings.HasPrefix(err.Error(), path+":3:") {
+		t.Errorf("Expected an error pointing at line 3, got %v", err)
+	}
+
+	if _, err := parseEnvFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -2,39 +2,250 @@ package commands
 
 import (
 	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/axelniklasson/plcli/lib"
 	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
 )
 
-// DiscoverHealthyNodes checks all nodes in the system to find out which are healthy
-func DiscoverHealthyNodes(sliceName string, attachToSlice bool) error {
-	nodes := pl.GetNodeIDsForSlice(sliceName)
-	log.Printf("Current list of nodes attached to slice %s: %v", sliceName, nodes)
+// sliceRollback restores the nodes of a slice to a previously recorded list of node ids unless committed
+type sliceRollback struct {
+	sliceName string
+	nodeIDs   []int
+	signals   chan os.Signal
+	done      bool
+	mux       sync.Mutex
+}
+
+// newSliceRollback records the nodes currently attached to a slice and restores them if the process is interrupted
+func newSliceRollback(sliceName string) *sliceRollback {
+	r := &sliceRollback{sliceName: sliceName, nodeIDs: pl.GetNodeIDsForSlice(sliceName), signals: make(chan os.Signal, 1)}
+
+	signal.Notify(r.signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		if _, ok := <-r.signals; ok {
+			log.Print("Interrupted, restoring nodes of slice before exiting")
+			r.restore()
+			os.Exit(1)
+		}
+	}()
+
+	return r
+}
+
+// finish marks the rollback as done and stops listening for interrupts, returns false if it was already done
+func (r *sliceRollback) finish() bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if r.done {
+		return false
+	}
+	r.done = true
+	signal.Stop(r.signals)
+	close(r.signals)
+	return true
+}
+
+// restore sets the nodes of the slice back to the recorded ones, unless already restored or committed
+func (r *sliceRollback) restore() {
+	if r.finish() {
+		log.Printf("Restoring nodes of slice %s to %v", r.sliceName, r.nodeIDs)
+		if err := pl.SetNodeIDsForSlice(r.sliceName, r.nodeIDs); err != nil {
+			log.Printf("Could not restore nodes of slice %s, attach them again with the PL API: %v", r.sliceName, err)
+		}
+	}
+}
+
+// commit keeps the current nodes of the slice, after which restore does nothing
+func (r *sliceRollback) commit() {
+	r.finish()
+}
+
+// polls without another node becoming ready after which waitForSlivers stops waiting for the remaining nodes
+const sliverStallPolls = 2
+
+// waitForSlivers polls nodes until the slice can be logged into over ssh on at least minReady of them or until
+// timeout has passed. Without minReady, it waits for all nodes but stops once the slice has reached some of them and
+// no other node has become ready for sliverStallPolls polls, so that dead nodes don't hold up the batch. Returns
+// the nodes that are ready.
+func waitForSlivers(sliceName string, nodes []pl.Node, minReady int, timeout time.Duration, pollInterval time.Duration) []pl.Node {
+	stallable := minReady <= 0
+	if minReady <= 0 || minReady > len(nodes) {
+		minReady = len(nodes)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ready := []pl.Node{}
+	pending := nodes
+	stalled := 0
+
+	for {
+		jobs := make(chan util.Job, len(pending))
+		results := make(chan util.JobResult, len(pending))
+		for _, n := range pending {
+			jobs <- util.Job{Func: func(i interface{}) (interface{}, error) {
+				node := i.(pl.Node)
+				connection, err := dialNode(sliceName, node.HostName)
+				if err == nil {
+					connection.Close()
+				}
+				return node, err
+			}, Args: n}
+		}
+		close(jobs)
+
+		workerCount := lib.WorkerPoolSize
+		if len(pending) < workerCount {
+			workerCount = len(pending)
+		}
+		for i := 0; i < workerCount; i++ {
+			go util.Worker(i, jobs, results)
+		}
 
-	// get all nodes in the system
-	allNodes := pl.GetAllNodes()
+		readyBefore := len(ready)
+		stillPending := []pl.Node{}
+		for j := 0; j < len(pending); j++ {
+			r := <-results
+			if r.Error == nil {
+				ready = append(ready, r.Result.(pl.Node))
+			} else {
+				stillPending = append(stillPending, r.Result.(pl.Node))
+			}
+		}
+		pending = stillPending
 
-	// attach all nodes in system to this slice
-	err := pl.SetNodesForSlice(sliceName, allNodes)
+		log.Printf("%d/%d nodes have the slice instantiated, waiting for at least %d", len(ready), len(nodes), minReady)
+		if len(ready) >= minReady || len(pending) == 0 {
+			return ready
+		}
+		if len(ready) > readyBefore {
+			stalled = 0
+		} else if len(ready) > 0 {
+			stalled++
+		}
+		if stallable && stalled >= sliverStallPolls {
+			log.Printf("No more nodes became ready in %d polls, giving up on %d nodes", stalled, len(pending))
+			return ready
+		}
+		if time.Now().Add(pollInterval).After(deadline) {
+			log.Printf("Gave up waiting for slice to be instantiated on %d nodes after %s", len(pending), timeout)
+			return ready
+		}
+
+		time.Sleep(pollInterval)
+	}
+}
+
+// discoveryCandidates removes nodes that are not booted, have not contacted PLC within maxLastContact or have a
+// health check result more recent than cacheTTL. Returns the nodes left to probe and the nodes known to be
+// healthy from the cached results.
+func discoveryCandidates(nodes []pl.Node, maxLastContact time.Duration, cacheTTL time.Duration) ([]pl.Node, []pl.Node) {
+	records, err := readHealthHistory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	latest := latestHealthRecords(records)
+
+	candidates := []pl.Node{}
+	cachedHealthy := []pl.Node{}
+	notBooted, stale := 0, 0
+	for _, n := range nodes {
+		if n.BootState != "boot" {
+			notBooted++
+			continue
+		}
+		if maxLastContact > 0 && time.Since(time.Unix(int64(n.LastContact), 0)) > maxLastContact {
+			stale++
+			continue
+		}
+		if r, exists := latest[n.HostName]; exists && cacheTTL > 0 && time.Since(r.CheckedAt) < cacheTTL {
+			if r.Healthy {
+				cachedHealthy = append(cachedHealthy, n)
+			}
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+
+	log.Printf("Skipping %d nodes not in boot state, %d nodes without recent contact and %d nodes with a recent health check, "+
+		"of which %d were healthy", notBooted, stale, len(nodes)-notBooted-stale-len(candidates), len(cachedHealthy))
+	return candidates, cachedHealthy
+}
+
+// DiscoverHealthyNodes checks nodes in the system to find out which are healthy. Nodes are attached to the slice
+// in batches, health checked and then detached again, until there are no more candidates or enough healthy nodes
+// have been found.
+func DiscoverHealthyNodes(sliceName string, attachToSlice bool, options *util.Options) error {
+	// restore the original nodes of the slice if anything goes wrong
+	rollback := newSliceRollback(sliceName)
+	defer rollback.restore()
+	log.Printf("Current list of nodes attached to slice %s: %v", sliceName, rollback.nodeIDs)
+
+	// get all nodes in the system and decide which ones to probe
+	// the PL API can fail at any point, which returns an error rather than exiting so that the deferred restore runs
+	allNodes, err := pl.FetchAllNodes()
 	if err != nil {
 		return err
 	}
+	candidates, healthyNodes := discoveryCandidates(allNodes, options.MaxLastContact, options.CacheTTL)
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = len(candidates)
+	}
+
+	for start := 0; start < len(candidates); start += batchSize {
+		if options.TargetHealthy > 0 && len(healthyNodes) >= options.TargetHealthy {
+			log.Printf("Found %d healthy nodes, which reaches the target of %d", len(healthyNodes), options.TargetHealthy)
+			break
+		}
+
+		end := start + batchSize
+		if end > len(candidates) {
+			end = len(candidates)
+		}
+		batch := candidates[start:end]
+		log.Printf("Probing nodes %d-%d of %d", start+1, end, len(candidates))
 
-	// wait for 20 minutes to allow the change in node ids of the slice to propagate throughout the system..
-	log.Print("Sleeping for 20 mins to allow for slice update to propagate throughout the system..")
-	time.Sleep(time.Minute * 20)
+		// attach batch to this slice, in addition to the original nodes
+		nodeIDs := append([]int{}, rollback.nodeIDs...)
+		for _, n := range batch {
+			nodeIDs = append(nodeIDs, n.NodeID)
+		}
+		err := pl.SetNodeIDsForSlice(sliceName, nodeIDs)
+		if err != nil {
+			return err
+		}
+
+		// wait for the change in node ids of the slice to propagate throughout the system..
+		log.Print("Waiting for slice update to propagate throughout the system..")
+		readyNodes := waitForSlivers(sliceName, batch, options.MinReady, options.PropagationTimeout, options.PollInterval)
+
+		// perform health check on all nodes where the slice has been instantiated
+		batchHealthy, _ := reportHealth(checkNodes(sliceName, readyNodes), "score")
+		healthyNodes = append(healthyNodes, batchHealthy...)
+
+		// detach batch again
+		err = pl.SetNodeIDsForSlice(sliceName, rollback.nodeIDs)
+		if err != nil {
+			return err
+		}
+	}
 
-	// perform health check on all attached nodes
-	healthyNodes := HealthCheck(sliceName, false)
+	// the slice has its original nodes again at this point
+	rollback.commit()
+	log.Printf("Discovered %d healthy nodes", len(healthyNodes))
 
-	// attach all healthy nodes to slice if desired, otherwise restore
+	// attach all healthy nodes to slice if desired
 	if attachToSlice {
-		// healthyNodes is a list of Nodes, hence the call to SetNodeForSlice
-		pl.SetNodesForSlice(sliceName, healthyNodes)
-	} else {
-		// nodes is a list of ids, hence the call to SetNodeIDsForSlice
-		pl.SetNodeIDsForSlice(sliceName, nodes)
+		if err := pl.SetNodesForSlice(sliceName, healthyNodes); err != nil {
+			return err
+		}
 	}
 
 	err = writeNodesToFile(healthyNodes)
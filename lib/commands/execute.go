@@ -8,6 +8,7 @@ import (
 	"log"
 	"sync"
 
+	"github.com/axelniklasson/plcli/lib"
 	"github.com/axelniklasson/plcli/lib/util"
 
 	"golang.org/x/crypto/ssh"
@@ -29,6 +30,33 @@ func ExecCmdOnNodes(hostnames []string, cmd string, options *util.Options) error
 	return nil
 }
 
+// dialNode opens an ssh connection to a node, logging in as the slice
+func dialNode(sliceName string, hostname string) (*ssh.Client, error) {
+	return ssh.Dial("tcp", fmt.Sprintf("%s:%d", hostname, lib.SSHPort), util.GetClientConfig(sliceName))
+}
+
+// ExecCmdOnNodeWithOutput executes a command on a hostname over ssh and returns what it wrote to stdout
+func ExecCmdOnNodeWithOutput(slice string, hostname string, cmd string) (string, error) {
+	if cmd == "" {
+		return "", errors.New("Can't execute empty command")
+	}
+
+	connection, err := dialNode(slice, hostname)
+	if err != nil {
+		return "", err
+	}
+	defer connection.Close()
+
+	session, err := connection.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	out, err := session.Output(cmd)
+	return string(out), err
+}
+
 // ExecCmdOnNode executes a command on a hostname over ssh
 func ExecCmdOnNode(slice string, hostname string, cmd string, showOutput bool) error {
 	sshConfig := util.GetClientConfig(slice)
@@ -0,0 +1,143 @@
+package commands
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var nodeLabels = []string{"hostname", "site", "slice"}
+
+var (
+	nodeUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_node_up",
+		Help: "Whether the node passed the latest health check (1) or not (0).",
+	}, nodeLabels)
+	nodeSSHLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_node_ssh_latency_seconds",
+		Help: "Time it took to complete the ssh handshake with the node in the latest health check.",
+	}, nodeLabels)
+	nodeCmdLatency = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_node_cmd_latency_seconds",
+		Help: "Round trip time of a command over ssh in the latest health check.",
+	}, nodeLabels)
+	nodeHealthScore = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_node_health_score",
+		Help: "Composite health score of the node between 0 and 100.",
+	}, nodeLabels)
+	sliceNodes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_slice_nodes_total",
+		Help: "Number of nodes attached to the slice.",
+	}, []string{"slice"})
+	sliceExpires = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_slice_expires_timestamp",
+		Help: "Unix timestamp at which the slice expires.",
+	}, []string{"slice"})
+	lastCheck = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "plcli_last_check_timestamp",
+		Help: "Unix timestamp of the latest completed round of health checks.",
+	}, []string{"slice"})
+)
+
+// nodeSeries are the label values of the metrics of a node, in the order of nodeLabels
+type nodeSeries [3]string
+
+// the node series every gauge was set for in the latest round, so that those that disappear can be deleted
+var exportedNodes = map[*prometheus.GaugeVec]map[nodeSeries]bool{}
+
+// collectMetrics queries the PL API and health checks all nodes of the slice, then updates all metrics. If the PL API
+// fails, the metrics of the previous round are kept.
+func collectMetrics(sliceName string) {
+	slices, err := pl.GetSlices(sliceName)
+	if err != nil {
+		log.Printf("Could not fetch slice %s, keeping previous metrics: %v", sliceName, err)
+		return
+	}
+	if len(slices) != 1 {
+		log.Printf("Expected exactly one slice matching %s, found %d", sliceName, len(slices))
+		return
+	}
+	slice := slices[0]
+
+	nodes, err := pl.FetchNodesDetails(slice.NodeIDs)
+	if err != nil {
+		log.Printf("Could not fetch nodes of slice %s, keeping previous metrics: %v", sliceName, err)
+		return
+	}
+	siteIDs := []int{}
+	for _, n := range nodes {
+		siteIDs = append(siteIDs, n.SiteID)
+	}
+	sites, err := pl.FetchSites(siteIDs)
+	if err != nil {
+		log.Printf("Could not fetch sites of slice %s, keeping previous metrics: %v", sliceName, err)
+		return
+	}
+	siteNames := map[int]string{}
+	for _, s := range sites {
+		siteNames[s.SiteID] = s.LoginBase
+	}
+	sliceExpires.WithLabelValues(sliceName).Set(float64(slice.Expires))
+	sliceNodes.WithLabelValues(sliceName).Set(float64(len(slice.NodeIDs)))
+
+	results := checkNodes(sliceName, nodes)
+
+	current := map[*prometheus.GaugeVec]map[nodeSeries]bool{}
+	set := func(g *prometheus.GaugeVec, s nodeSeries, value float64) {
+		g.WithLabelValues(s[:]...).Set(value)
+		if current[g] == nil {
+			current[g] = map[nodeSeries]bool{}
+		}
+		current[g][s] = true
+	}
+	for _, r := range results {
+		s := nodeSeries{r.Node.HostName, siteNames[r.Node.SiteID], sliceName}
+		up := 0.0
+		if r.IsHealthy {
+			up = 1
+		}
+		set(nodeUp, s, up)
+		set(nodeHealthScore, s, r.Score)
+		if r.SSHLatency > 0 {
+			set(nodeSSHLatency, s, r.SSHLatency.Seconds())
+		}
+		if r.CmdLatency > 0 {
+			set(nodeCmdLatency, s, r.CmdLatency.Seconds())
+		}
+	}
+	// only once all nodes are updated, series of nodes no longer attached to the slice or no longer measured are
+	// deleted, so that a scrape never misses a node that is still there
+	for g, series := range exportedNodes {
+		for s := range series {
+			if !current[g][s] {
+				g.DeleteLabelValues(s[:]...)
+			}
+		}
+	}
+	exportedNodes = current
+	lastCheck.WithLabelValues(sliceName).SetToCurrentTime()
+
+	log.Printf("Updated metrics for %d nodes of slice %s", len(results), sliceName)
+}
+
+// Exporter periodically health checks the nodes of a slice and exposes the results as Prometheus metrics
+func Exporter(sliceName string, options *util.Options) error {
+	prometheus.MustRegister(nodeUp, nodeSSHLatency, nodeCmdLatency, nodeHealthScore, sliceNodes, sliceExpires, lastCheck)
+
+	go func() {
+		for {
+			collectMetrics(sliceName)
+			time.Sleep(options.ExporterInterval)
+		}
+	}()
+
+	http.Handle("/metrics", promhttp.Handler())
+	log.Printf("Exposing metrics for slice %s on %s/metrics", sliceName, options.Listen)
+	return http.ListenAndServe(options.Listen, nil)
+}
@@ -3,11 +3,17 @@ package commands
 import (
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
 	"time"
 
 	"github.com/axelniklasson/plcli/lib"
 	"github.com/axelniklasson/plcli/lib/pl"
 	"github.com/axelniklasson/plcli/lib/util"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type funcArgs struct {
@@ -15,9 +21,82 @@ type funcArgs struct {
 	Node      pl.Node
 }
 
+// checkResult holds the outcome of a single step of a node health check
+type checkResult struct {
+	Name     string
+	OK       bool
+	Error    string
+	Duration time.Duration
+}
+
+// healthCheckResult holds the outcome of all steps of a node health check
 type healthCheckResult struct {
 	Node      pl.Node
 	IsHealthy bool
+	Checks    []checkResult
+	// time it took to complete the ssh handshake with the node
+	SSHLatency time.Duration
+	// round trip time of a trivial command over an established ssh connection
+	CmdLatency time.Duration
+	// composite score between 0 and 100, healthy nodes always score at least 50
+	Score float64
+}
+
+// record appends the result of a check and returns whether it passed
+func (r *healthCheckResult) record(name string, start time.Time, err error) bool {
+	c := checkResult{Name: name, OK: err == nil, Duration: time.Since(start)}
+	if err != nil {
+		c.Error = err.Error()
+	}
+	r.Checks = append(r.Checks, c)
+	return err == nil
+}
+
+// FailedCheck returns the name and error of the first failed check, or an empty string if all checks passed
+func (r healthCheckResult) FailedCheck() string {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return fmt.Sprintf("%s: %s", c.Name, c.Error)
+		}
+	}
+	return ""
+}
+
+// all checks performed by isHealthy, in order
+var healthChecks = []string{"dns", "ping", "ssh", "exec", "transfer", "script", "port", "cleanup"}
+
+// latency above which a healthy node gets the lowest possible score
+const maxHealthyLatency = time.Second * 2
+
+// computeScore scores a node based on how many checks passed and how fast it responded over ssh
+func computeScore(r healthCheckResult) float64 {
+	passed := 0
+	for _, c := range r.Checks {
+		if c.OK {
+			passed++
+		}
+	}
+
+	if !r.IsHealthy {
+		return 50 * float64(passed) / float64(len(healthChecks))
+	}
+
+	latency := r.SSHLatency + r.CmdLatency
+	if latency > maxHealthyLatency {
+		latency = maxHealthyLatency
+	}
+	return 50 + 50*(1-float64(latency)/float64(maxHealthyLatency))
+}
+
+// runOverConnection runs cmd in a new session on an established ssh connection
+func runOverConnection(connection *ssh.Client, cmd string) error {
+	session, err := connection.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	return session.Run(cmd)
 }
 
 func isHealthy(i interface{}) (interface{}, error) {
@@ -25,48 +104,71 @@ func isHealthy(i interface{}) (interface{}, error) {
 	args := i.(funcArgs)
 	sliceName := args.SliceName
 	node := args.Node
+	res := healthCheckResult{Node: node}
 
 	log.Printf("Performing health check for node %s", node.HostName)
 
-	err := util.PingHost(node.HostName)
-	if err != nil {
+	start := time.Now()
+	_, err := net.LookupHost(node.HostName)
+	if !res.record("dns", start, err) {
+		log.Printf("Could not resolve hostname of node %s", node.HostName)
+		return finish(res), nil
+	}
+
+	start = time.Now()
+	err = util.PingHost(node.HostName)
+	if !res.record("ping", start, err) {
 		log.Printf("Could not ping node %s", node.HostName)
-		return healthCheckResult{node, false}, nil
+		return finish(res), nil
+	}
+
+	// connect over ssh and measure the handshake
+	start = time.Now()
+	connection, err := dialNode(sliceName, node.HostName)
+	if !res.record("ssh", start, err) {
+		log.Printf("Could not connect to node %s over ssh: %v", node.HostName, err)
+		return finish(res), err
 	}
 
+	res.SSHLatency = time.Since(start)
+
 	// try executing a command on node
-	err = ExecCmdOnNode(sliceName, node.HostName, "ls /", false)
-	if err != nil {
-		log.Printf("Could not connect/execute command on node %s", node.HostName)
-		return healthCheckResult{node, false}, err
+	start = time.Now()
+	err = runOverConnection(connection, "ls /")
+	res.CmdLatency = time.Since(start)
+	connection.Close()
+	if !res.record("exec", start, err) {
+		log.Printf("Could not execute command on node %s", node.HostName)
+		return finish(res), err
 	}
 
 	// transfer healthcheck script
+	start = time.Now()
 	err = Transfer(sliceName, node.HostName, fmt.Sprintf("%s/scripts/healthcheck.sh", lib.BasePath), "~/healthcheck.sh")
-	if err != nil {
+	if !res.record("transfer", start, err) {
 		log.Printf("Could not transfer healthcheck script to node %s", node.HostName)
-		return healthCheckResult{node, false}, err
+		return finish(res), err
 	}
 
-	// run healthcheck script
-	err = ExecCmdOnNode(sliceName, node.HostName, "cd ~; nohup sh healthcheck.sh > /dev/null 2>&1 &", false)
-	if err != nil {
+	// run healthcheck script in its own process group, recording its pid so that only it is killed afterwards
+	start = time.Now()
+	err = ExecCmdOnNode(sliceName, node.HostName, "cd ~; setsid nohup sh healthcheck.sh > /dev/null 2>&1 < /dev/null & echo $! > ~/healthcheck.pid", false)
+	if !res.record("script", start, err) {
 		log.Printf("Something went wrong with running healthcheck script on node %s", node.HostName)
-		return healthCheckResult{node, false}, err
+		return finish(res), err
 	}
 
 	// sleep 3s to wait for healthcheck script to start
 	time.Sleep(time.Second * 3)
 
 	// check if port 9876 is opened by healthcheck script. maximum 10 tries.
+	start = time.Now()
 	tries := 1
-	portOpen := false
 	for {
 		tries = tries + 1
 
 		err = util.CheckPortOpen(node.HostName, 9876)
 		if err == nil {
-			portOpen = true
 			break
 		} else {
 			// wait for 2s before retry
@@ -78,42 +180,40 @@ func isHealthy(i interface{}) (interface{}, error) {
 		}
 	}
 
-	if !portOpen {
+	if !res.record("port", start, err) {
 		log.Printf("Could not open port 9876 on node %s", node.HostName)
-		return healthCheckResult{node, false}, err
+		return finish(res), err
 	}
 
-	// kill healthcheck script and remove from host
-	err = ExecCmdOnNode(sliceName, node.HostName, "kill -9 -1; rm ~/healthcheck.sh", false)
-	if err != nil {
-		return healthCheckResult{node, false}, err
+	// kill healthcheck script along with the server it started and remove it from host, leaving any other processes
+	// of the slice, like deployed apps, running
+	start = time.Now()
+	err = ExecCmdOnNode(sliceName, node.HostName, "kill -9 -- -$(cat ~/healthcheck.pid) 2>/dev/null; rm -f ~/healthcheck.sh ~/healthcheck.pid", false)
+	if !res.record("cleanup", start, err) {
+		return finish(res), err
 	}
 
-	// if all succeeds, return true
-	return healthCheckResult{node, true}, nil
+	// if all succeeds, node is healthy
+	res.IsHealthy = true
+	return finish(res), nil
 }
 
-// HealthCheck checks all nodes attached to a slice to find out which ones are healthy
-// healthy nodes are online and able to open a random port between 3000 and 9999
-func HealthCheck(sliceName string, removeFaulty bool) []pl.Node {
-	// get all nodes attached to slice
-	nodes, err := pl.GetNodesForSlice(sliceName)
-	if err != nil {
-		log.Fatal(err)
-	}
+// finish computes the score of a health check result once all checks have been run
+func finish(r healthCheckResult) healthCheckResult {
+	r.Score = computeScore(r)
+	return r
+}
 
+// checkNodes health checks the given nodes concurrently, stores the results in the health history and
+// returns them in no particular order
+func checkNodes(sliceName string, nodes []pl.Node) []healthCheckResult {
 	// setup channels to write jobs and get back jobresults
 	jobs := make(chan util.Job, len(nodes))
 	results := make(chan util.JobResult, len(nodes))
 
 	// construct jobs and write over channel
 	for _, n := range nodes {
-		args := funcArgs{sliceName, n}
-		workerFunc := func(i interface{}) (interface{}, error) {
-			args = i.(funcArgs)
-			return isHealthy(args)
-		}
-		jobs <- util.Job{Func: workerFunc, Args: args}
+		jobs <- util.Job{Func: isHealthy, Args: funcArgs{sliceName, n}}
 	}
 	close(jobs)
 
@@ -126,48 +226,103 @@ func HealthCheck(sliceName string, removeFaulty bool) []pl.Node {
 		go util.Worker(i, jobs, results)
 	}
 
-	// gather results, store all healthy nodes in healthyNodes slice
-	healthyNodes := []pl.Node{}
-	faultyNodes := []pl.Node{}
+	checked := []healthCheckResult{}
 	for j := 0; j < len(nodes); j++ {
 		r := <-results
-		jobResult := r.Result.(healthCheckResult)
-		if jobResult.IsHealthy {
-			healthyNodes = append(healthyNodes, jobResult.Node)
-		} else {
-			faultyNodes = append(faultyNodes, jobResult.Node)
+		checked = append(checked, r.Result.(healthCheckResult))
+		log.Printf("Job %d/%d finished!", len(checked), len(nodes))
+	}
+
+	if err := appendHealthHistory(sliceName, checked); err != nil {
+		log.Printf("Could not store health check results in health history: %v", err)
+	}
+
+	return checked
+}
+
+// sortHealthResults sorts results in place by the given key: score (best first), hostname, ssh or cmd (fastest first)
+func sortHealthResults(results []healthCheckResult, sortBy string) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		switch sortBy {
+		case "hostname":
+			return a.Node.HostName < b.Node.HostName
+		case "ssh", "cmd":
+			la, lb := a.CmdLatency, b.CmdLatency
+			if sortBy == "ssh" {
+				la, lb = a.SSHLatency, b.SSHLatency
+			}
+			// nodes that never answered over ssh have no latency and are placed last
+			if (la > 0) != (lb > 0) {
+				return la > 0
+			}
+			return la < lb
+		default:
+			return a.Score > b.Score
 		}
+	})
+}
 
-		log.Printf("Job %d/%d finished!", len(healthyNodes)+len(faultyNodes), len(nodes))
+// printHealthReport prints a table with one line per checked node
+func printHealthReport(results []healthCheckResult) {
+	fmt.Println("")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tID\tSTATUS\tSCORE\tSSH RTT\tCMD RTT\tREASON")
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%.1f\t%s\t%s\t%s\n", r.Node.HostName, r.Node.NodeID, healthStatus(r.IsHealthy), r.Score,
+			r.SSHLatency.Round(time.Millisecond), r.CmdLatency.Round(time.Millisecond), r.FailedCheck())
 	}
+	w.Flush()
+	fmt.Println("")
+}
+
+// reportHealth prints a report of the results ordered by sortBy and returns the healthy nodes, best scoring
+// first, and the faulty nodes
+func reportHealth(results []healthCheckResult, sortBy string) ([]pl.Node, []pl.Node) {
+	sortHealthResults(results, sortBy)
+	printHealthReport(results)
 
-	// pretty-print results from health check
+	sortHealthResults(results, "score")
+	healthyNodes := []pl.Node{}
+	faultyNodes := []pl.Node{}
+	for _, r := range results {
+		if r.IsHealthy {
+			healthyNodes = append(healthyNodes, r.Node)
+		} else {
+			faultyNodes = append(faultyNodes, r.Node)
+		}
+	}
 	log.Printf("Found %d healthy and %d faulty nodes!\n", len(healthyNodes), len(faultyNodes))
-	prettyPrint("### Healthy nodes ###", healthyNodes)
-	prettyPrint("### Faulty nodes ###", faultyNodes)
-	fmt.Println("")
+
+	return healthyNodes, faultyNodes
+}
+
+// HealthCheck checks all nodes attached to a slice to find out which ones are healthy
+// healthy nodes are online and able to open a random port between 3000 and 9999. The returned
+// healthy nodes are ordered by score, best first, while the printed report is ordered by sortBy.
+func HealthCheck(sliceName string, removeFaulty bool, sortBy string) []pl.Node {
+	// get all nodes attached to slice
+	nodes, err := pl.GetNodesForSlice(sliceName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	results := checkNodes(sliceName, nodes)
+	healthyNodes, faultyNodes := reportHealth(results, sortBy)
 
 	if removeFaulty {
 		if len(faultyNodes) == 0 {
 			log.Print("No faulty nodes to remove!")
 		} else {
-			pl.SetNodesForSlice(sliceName, healthyNodes)
+			if err := pl.SetNodesForSlice(sliceName, healthyNodes); err != nil {
+				log.Fatal(err)
+			}
 		}
 	}
 
 	return healthyNodes
 }
 
-func prettyPrint(header string, nodes []pl.Node) {
-	fmt.Printf("\n%s\n", header)
-	if len(nodes) == 0 {
-		fmt.Println("No nodes to print!")
-	}
-	for _, n := range nodes {
-		fmt.Printf("%s [%d]\n", n.HostName, n.NodeID)
-	}
-}
-
 // JobResult is used to write results from workers back to main thread
 type JobResult struct {
 	Node      pl.Node
@@ -0,0 +1,39 @@
+package commands
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+)
+
+func TestSortHealthResults(t *testing.T) {
+	result := func(hostname string, healthy bool, score float64, ssh time.Duration, cmd time.Duration) healthCheckResult {
+		return healthCheckResult{Node: pl.Node{HostName: hostname}, IsHealthy: healthy, Score: score, SSHLatency: ssh, CmdLatency: cmd}
+	}
+	results := []healthCheckResult{
+		result("unreachable", false, 0, 0, 0),
+		result("slow", true, 60, time.Second, time.Millisecond*300),
+		result("failing", false, 10, time.Millisecond*100, time.Millisecond*200),
+		result("fast", true, 90, time.Millisecond*200, time.Millisecond*100),
+	}
+	tests := map[string][]string{
+		"score":    {"fast", "slow", "failing", "unreachable"},
+		"hostname": {"failing", "fast", "slow", "unreachable"},
+		// nodes that answered over ssh come first by latency, whether or not they passed the other checks
+		"ssh": {"failing", "fast", "slow", "unreachable"},
+		"cmd": {"fast", "failing", "slow", "unreachable"},
+	}
+	for sortBy, expected := range tests {
+		sorted := append([]healthCheckResult{}, results...)
+		sortHealthResults(sorted, sortBy)
+		hostnames := []string{}
+		for _, r := range sorted {
+			hostnames = append(hostnames, r.Node.HostName)
+		}
+		if !reflect.DeepEqual(hostnames, expected) {
+			t.Errorf("Sorted by %s as %v, expected %v", sortBy, hostnames, expected)
+		}
+	}
+}
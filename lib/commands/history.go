@@ -0,0 +1,362 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// file in the plcli data dir holding one json encoded healthRecord per line
+const healthHistoryFile = "health_history.json"
+
+// records older than healthHistoryRetention are dropped from the health history, once the oldest record is
+// healthHistoryCompactSlack past it so that the file isn't rewritten on every append
+const (
+	healthHistoryRetention    = time.Hour * 24 * 30
+	healthHistoryCompactSlack = time.Hour * 24 * 3
+)
+
+// healthRecord is a health check result as stored in the health history
+type healthRecord struct {
+	Hostname   string        `json:"hostname"`
+	NodeID     int           `json:"node_id"`
+	Slice      string        `json:"slice"`
+	CheckedAt  time.Time     `json:"checked_at"`
+	Healthy    bool          `json:"healthy"`
+	Score      float64       `json:"score"`
+	SSHLatency time.Duration `json:"ssh_latency"`
+	CmdLatency time.Duration `json:"cmd_latency"`
+	Reason     string        `json:"reason,omitempty"`
+}
+
+// nodeReliability summarizes the health history of a node
+type nodeReliability struct {
+	Hostname    string
+	Checks      int
+	LastChecked time.Time
+	LastHealthy bool
+	// fraction of checks where the node was healthy
+	Uptime float64
+	// fraction of consecutive checks where the node changed between healthy and faulty
+	FlapRate float64
+}
+
+// Reliability combines uptime and flap rate into a value between 0 and 1, where 1 means always healthy
+func (r nodeReliability) Reliability() float64 {
+	return r.Uptime * (1 - r.FlapRate)
+}
+
+func healthHistoryPath() (string, error) {
+	dir, err := util.DataDirPath()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s", dir, healthHistoryFile), nil
+}
+
+// lockHealthHistory takes an exclusive lock on the health history at path, which is held until the returned file is
+// closed. The lock is taken on a file next to the history, since compacting replaces the history itself.
+func lockHealthHistory(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// appendHealthHistory stores the given health check results in the health history. Concurrent plcli processes
+// appending to it, like watch and the exporter, are serialized by a lock, so that compacting doesn't drop records.
+func appendHealthHistory(sliceName string, results []healthCheckResult) error {
+	path, err := healthHistoryPath()
+	if err != nil {
+		return err
+	}
+
+	lock, err := lockHealthHistory(path)
+	if err != nil {
+		return fmt.Errorf("Could not lock health history: %v", err)
+	}
+	defer lock.Close()
+
+	// compact before opening, the file is replaced when compacted
+	if err := compactHealthHistory(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("Could not compact health history: %v", err)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	now := time.Now()
+	for _, r := range results {
+		err = encoder.Encode(healthRecord{
+			Hostname:   r.Node.HostName,
+			NodeID:     r.Node.NodeID,
+			Slice:      sliceName,
+			CheckedAt:  now,
+			Healthy:    r.IsHealthy,
+			Score:      r.Score,
+			SSHLatency: r.SSHLatency,
+			CmdLatency: r.CmdLatency,
+			Reason:     r.FailedCheck(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// compactHealthHistory drops records older than healthHistoryRetention from the health history at path, if its
+// oldest record is older than that by more than healthHistoryCompactSlack. The caller holds the lock of the history.
+func compactHealthHistory(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	oldest := healthRecord{}
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		json.Unmarshal(scanner.Bytes(), &oldest)
+	}
+	f.Close()
+	if oldest.CheckedAt.IsZero() || time.Since(oldest.CheckedAt) < healthHistoryRetention+healthHistoryCompactSlack {
+		return nil
+	}
+
+	records, err := readHealthHistory()
+	if err != nil {
+		return err
+	}
+	buf := bytes.Buffer{}
+	encoder := json.NewEncoder(&buf)
+	kept := windowRecords(records, healthHistoryRetention)
+	for _, r := range kept {
+		if err := encoder.Encode(r); err != nil {
+			return err
+		}
+	}
+	log.Printf("Dropping %d health checks older than %s from the health history", len(records)-len(kept), healthHistoryRetention)
+	return util.WriteFileAtomic(path, buf.Bytes(), 0644)
+}
+
+// windowRecords returns the records checked within window before now, or all records if window is 0
+func windowRecords(records []healthRecord, window time.Duration) []healthRecord {
+	if window <= 0 {
+		return records
+	}
+	since := time.Now().Add(-window)
+	recent := []healthRecord{}
+	for _, r := range records {
+		if r.CheckedAt.After(since) {
+			recent = append(recent, r)
+		}
+	}
+	return recent
+}
+
+// parseWindow parses a duration like time.ParseDuration, additionally accepting whole days such as 7d
+func parseWindow(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return 0, fmt.Errorf("Malformed window %s", s)
+		}
+		return time.Hour * 24 * time.Duration(days), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("Malformed window %s", s)
+	}
+	return d, nil
+}
+
+// readHealthHistory returns all records in the health history, oldest first
+func readHealthHistory() ([]healthRecord, error) {
+	path, err := healthHistoryPath()
+	if err != nil {
+		return nil, err
+	}
+
+	records := []healthRecord{}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return records, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		r := healthRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("Malformed health history in %s: %v", path, err)
+		}
+		records = append(records, r)
+	}
+
+	return records, scanner.Err()
+}
+
+// latestHealthRecords returns the most recent record per hostname
+func latestHealthRecords(records []healthRecord) map[string]healthRecord {
+	latest := map[string]healthRecord{}
+	for _, r := range records {
+		if prev, exists := latest[r.Hostname]; !exists || r.CheckedAt.After(prev.CheckedAt) {
+			latest[r.Hostname] = r
+		}
+	}
+	return latest
+}
+
+// computeReliability summarizes the health history per hostname
+func computeReliability(records []healthRecord) map[string]nodeReliability {
+	byHostname := map[string][]healthRecord{}
+	for _, r := range records {
+		byHostname[r.Hostname] = append(byHostname[r.Hostname], r)
+	}
+
+	summaries := map[string]nodeReliability{}
+	for hostname, rs := range byHostname {
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].CheckedAt.Before(rs[j].CheckedAt) })
+
+		healthy, flaps := 0, 0
+		for i, r := range rs {
+			if r.Healthy {
+				healthy++
+			}
+			if i > 0 && r.Healthy != rs[i-1].Healthy {
+				flaps++
+			}
+		}
+
+		summary := nodeReliability{
+			Hostname:    hostname,
+			Checks:      len(rs),
+			LastChecked: rs[len(rs)-1].CheckedAt,
+			LastHealthy: rs[len(rs)-1].Healthy,
+			Uptime:      float64(healthy) / float64(len(rs)),
+		}
+		if len(rs) > 1 {
+			summary.FlapRate = float64(flaps) / float64(len(rs)-1)
+		}
+		summaries[hostname] = summary
+	}
+
+	return summaries
+}
+
+// removeUnreliable removes nodes whose reliability according to the health checks within window is below
+// minReliability. Nodes without any history in the window are kept.
+func removeUnreliable(nodes []pl.Node, minReliability float64, window string) []pl.Node {
+	d, err := parseWindow(window)
+	if err != nil {
+		log.Fatal(err)
+	}
+	records, err := readHealthHistory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	summaries := computeReliability(windowRecords(records, d))
+
+	okNodes := []pl.Node{}
+	for _, n := range nodes {
+		summary, exists := summaries[n.HostName]
+		if exists && summary.Reliability() < minReliability {
+			log.Printf("Removing node %s from deployment, reliability %.2f is below %.2f", n.HostName, summary.Reliability(), minReliability)
+			continue
+		}
+		okNodes = append(okNodes, n)
+	}
+
+	return okNodes
+}
+
+// HealthHistory prints the health checks of a node recorded within window, or a reliability summary of all nodes
+// over that window if hostname is empty
+func HealthHistory(hostname string, window string) error {
+	d, err := parseWindow(window)
+	if err != nil {
+		return err
+	}
+	records, err := readHealthHistory()
+	if err != nil {
+		return err
+	}
+	records = windowRecords(records, d)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if hostname == "" {
+		summaries := []nodeReliability{}
+		for _, s := range computeReliability(records) {
+			summaries = append(summaries, s)
+		}
+		sort.Slice(summaries, func(i, j int) bool {
+			if summaries[i].Reliability() != summaries[j].Reliability() {
+				return summaries[i].Reliability() > summaries[j].Reliability()
+			}
+			return summaries[i].Hostname < summaries[j].Hostname
+		})
+
+		fmt.Fprintln(w, "HOSTNAME\tCHECKS\tUPTIME\tFLAP RATE\tRELIABILITY\tLAST STATUS\tLAST CHECKED")
+		for _, s := range summaries {
+			fmt.Fprintf(w, "%s\t%d\t%.0f%%\t%.0f%%\t%.2f\t%s\t%s\n", s.Hostname, s.Checks, s.Uptime*100, s.FlapRate*100,
+				s.Reliability(), healthStatus(s.LastHealthy), s.LastChecked.Format(time.RFC3339))
+		}
+		return nil
+	}
+
+	nodeRecords := []healthRecord{}
+	for _, r := range records {
+		if r.Hostname == hostname {
+			nodeRecords = append(nodeRecords, r)
+		}
+	}
+	if len(nodeRecords) == 0 {
+		log.Printf("No health history found for node %s", hostname)
+		return nil
+	}
+
+	fmt.Fprintln(w, "CHECKED AT\tSLICE\tSTATUS\tSCORE\tSSH RTT\tCMD RTT\tREASON")
+	for _, r := range nodeRecords {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%.1f\t%s\t%s\t%s\n", r.CheckedAt.Format(time.RFC3339), r.Slice, healthStatus(r.Healthy),
+			r.Score, r.SSHLatency.Round(time.Millisecond), r.CmdLatency.Round(time.Millisecond), r.Reason)
+	}
+
+	s := computeReliability(nodeRecords)[hostname]
+	fmt.Fprintf(w, "\nUptime: %.0f%%, flap rate: %.0f%%, reliability: %.2f over %d checks\n", s.Uptime*100, s.FlapRate*100, s.Reliability(), s.Checks)
+	return nil
+}
+
+func healthStatus(healthy bool) string {
+	if healthy {
+		return "healthy"
+	}
+	return "faulty"
+}
@@ -0,0 +1,135 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+)
+
+func TestParseWindow(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":    0,
+		"7d":  time.Hour * 24 * 7,
+		"0d":  0,
+		"12h": time.Hour * 12,
+		"90m": time.Minute * 90,
+	}
+	for s, expected := range tests {
+		d, err := parseWindow(s)
+		if err != nil || d != expected {
+			t.Errorf("parseWindow(%q) = %s, %v, expected %s", s, d, err, expected)
+		}
+	}
+
+	for _, s := range []string{"d", "1.5d", "-1d", "-1h", "week", "7"} {
+		if _, err := parseWindow(s); err == nil {
+			t.Errorf("Expected an error for window %q", s)
+		}
+	}
+}
+
+func TestWindowRecords(t *testing.T) {
+	now := time.Now()
+	records := []healthRecord{{Hostname: "old", CheckedAt: now.Add(-time.Hour * 48)}, {Hostname: "new", CheckedAt: now.Add(-time.Hour)}}
+
+	if recent := windowRecords(records, time.Hour*24); len(recent) != 1 || recent[0].Hostname != "new" {
+		t.Errorf("Records within a day are %v, expected only the new one", recent)
+	}
+	if all := windowRecords(records, 0); len(all) != 2 {
+		t.Errorf("A window of 0 kept %d records, expected all of them", len(all))
+	}
+}
+
+func TestComputeReliability(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(minutes int) time.Time { return start.Add(time.Minute * time.Duration(minutes)) }
+	// records are out of order on purpose, they are summarized in the order they were checked in
+	records := []healthRecord{
+		{Hostname: "flaky", CheckedAt: at(2), Healthy: true},
+		{Hostname: "flaky", CheckedAt: at(0), Healthy: true},
+		{Hostname: "flaky", CheckedAt: at(1), Healthy: false},
+		{Hostname: "flaky", CheckedAt: at(3), Healthy: false},
+		{Hostname: "stable", CheckedAt: at(0), Healthy: true},
+		{Hostname: "stable", CheckedAt: at(1), Healthy: true},
+		{Hostname: "once", CheckedAt: at(0), Healthy: false},
+	}
+	summaries := computeReliability(records)
+
+	flaky := summaries["flaky"]
+	if flaky.Checks != 4 || flaky.Uptime != 0.5 || flaky.FlapRate != 1 || flaky.LastHealthy || !flaky.LastChecked.Equal(at(3)) {
+		t.Errorf("Summary of flaky node is %+v", flaky)
+	}
+	if flaky.Reliability() != 0 {
+		t.Errorf("Reliability of a node flapping on every check is %.2f, expected 0", flaky.Reliability())
+	}
+
+	stable := summaries["stable"]
+	if stable.Checks != 2 || stable.Uptime != 1 || stable.FlapRate != 0 || stable.Reliability() != 1 {
+		t.Errorf("Summary of stable node is %+v", stable)
+	}
+
+	once := summaries["once"]
+	if once.Checks != 1 || once.Uptime != 0 || once.FlapRate != 0 || once.Reliability() != 0 {
+		t.Errorf("Summary of node checked once is %+v", once)
+	}
+}
+
+func TestNodeReliability(t *testing.T) {
+	r := nodeReliability{Uptime: 0.9, FlapRate: 0.2}
+	if math.Abs(r.Reliability()-0.72) > 1e-9 {
+		t.Errorf("Reliability with 90%% uptime and 20%% flap rate is %.4f, expected 0.72", r.Reliability())
+	}
+}
+
+func TestAppendHealthHistoryCompacts(t *testing.T) {
+	useTempHome(t)
+	path, err := healthHistoryPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired := healthRecord{Hostname: "expired", CheckedAt: time.Now().Add(-healthHistoryRetention - healthHistoryCompactSlack - time.Hour)}
+	kept := healthRecord{Hostname: "kept", CheckedAt: time.Now().Add(-time.Hour)}
+	data := []byte{}
+	for _, r := range []healthRecord{expired, kept} {
+		line, _ := json.Marshal(r)
+		data = append(append(data, line...), '\n')
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent appends all end up in the history, none of them lost to the compaction
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := appendHealthHistory("slice", []healthCheckResult{{Node: pl.Node{HostName: "new"}, IsHealthy: true}}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	records, err := readHealthHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for _, r := range records {
+		counts[r.Hostname]++
+	}
+	if counts["expired"] != 0 || counts["kept"] != 1 || counts["new"] != 10 {
+		t.Errorf("Health history holds %v, expected the kept record and 10 new ones", counts)
+	}
+	if _, err := os.Stat(path + ".lock"); err != nil {
+		t.Errorf("Lock file missing: %v", err)
+	}
+}
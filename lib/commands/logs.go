@@ -0,0 +1,196 @@
+package commands
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// timestamp layouts recognized at the start of log lines by --since, the layouts without a zone are read as local time
+var logTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006/01/02 15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// logFilter decides which log lines of an instance are shown
+type logFilter struct {
+	since   time.Time
+	pattern *regexp.Regexp
+	// whether the last timestamped line was recent enough, which lines without a timestamp inherit
+	recent bool
+}
+
+// newLogFilter creates a filter from the --since and --grep options
+func newLogFilter(since time.Duration, grep string) (*logFilter, error) {
+	f := &logFilter{recent: true}
+	if since > 0 {
+		f.since = time.Now().Add(-since)
+	}
+	if grep != "" {
+		pattern, err := regexp.Compile(grep)
+		if err != nil {
+			return nil, fmt.Errorf("Malformed grep pattern: %v", err)
+		}
+		f.pattern = pattern
+	}
+	return f, nil
+}
+
+// lineTime returns the timestamp a log line starts with, if any
+func lineTime(line string) (time.Time, bool) {
+	for _, layout := range logTimeLayouts {
+		prefix := line
+		if layout == time.RFC3339Nano {
+			prefix = strings.SplitN(line, " ", 2)[0]
+		} else if len(line) >= len(layout) {
+			prefix = line[:len(layout)]
+		}
+		if t, err := time.ParseInLocation(layout, prefix, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// match returns whether a line is shown. Lines are filtered by the timestamp they start with, lines without one,
+// like stack traces, are shown along with the last line that had one.
+func (f *logFilter) match(line string) bool {
+	if !f.since.IsZero() {
+		if t, ok := lineTime(line); ok {
+			f.recent = !t.Before(f.since)
+		}
+		if !f.recent {
+			return false
+		}
+	}
+	return f.pattern == nil || f.pattern.MatchString(line)
+}
+
+// logsCmd builds the command that prints the last lines of the log of an instance, following it if desired. A
+// lines of 0 prints the whole log.
+func logsCmd(instanceID int, lines int, follow bool) string {
+	from := fmt.Sprintf("%d", lines)
+	if lines <= 0 {
+		from = "+1"
+	}
+	if follow {
+		// -F keeps following the log across rotations by plcli-supervisor
+		return fmt.Sprintf("tail -n %s -F ~/logs/instance_%d.log", from, instanceID)
+	}
+	return fmt.Sprintf("tail -n %s ~/logs/instance_%d.log", from, instanceID)
+}
+
+// streamCmdOnNode executes a command on a node and calls f with every line it writes to stdout, until it exits
+func streamCmdOnNode(sliceName string, hostname string, cmd string, f func(line string)) error {
+	connection, err := dialNode(sliceName, hostname)
+	if err != nil {
+		return err
+	}
+	defer connection.Close()
+
+	session, err := connection.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Unable to setup stdout for session: %v", err)
+	}
+	if err := session.Start(cmd); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		f(scanner.Text())
+	}
+	return session.Wait()
+}
+
+// Logs prints the logs of the given instances of a deployment, or all of them if instanceIDs is empty, with every
+// line prefixed by the hostname and instance ID in the color of the node. Logs of all instances are interleaved as
+// they arrive when following them, and printed one instance after the other otherwise.
+func Logs(deploymentID string, options *util.Options) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	instances, err := selectInstances(m, options.Instances)
+	if err != nil {
+		return err
+	}
+	if _, err := newLogFilter(options.Since, options.Grep); err != nil {
+		return err
+	}
+
+	mux := sync.Mutex{}
+	printLine := func(i deploymentInstance, line string) {
+		mux.Lock()
+		util.GetColorForHostname(i.Hostname)("%s [%d] ===> %s\n", i.Hostname, i.ID, line)
+		mux.Unlock()
+	}
+
+	if options.Follow {
+		wg := sync.WaitGroup{}
+		for _, i := range instances {
+			wg.Add(1)
+			go func(i deploymentInstance) {
+				defer wg.Done()
+				filter, _ := newLogFilter(options.Since, options.Grep)
+				err := streamCmdOnNode(m.Slice, i.Hostname, logsCmd(i.ID, options.LogLines, true), func(line string) {
+					if filter.match(line) {
+						printLine(i, line)
+					}
+				})
+				if err != nil {
+					log.Printf("Following log of instance %d on node %s failed: %v", i.ID, i.Hostname, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+		return nil
+	}
+
+	outputs := make([]string, len(instances))
+	errs := make([]error, len(instances))
+	wg := sync.WaitGroup{}
+	for idx, i := range instances {
+		wg.Add(1)
+		go func(idx int, i deploymentInstance) {
+			defer wg.Done()
+			outputs[idx], errs[idx] = ExecCmdOnNodeWithOutput(m.Slice, i.Hostname, logsCmd(i.ID, options.LogLines, false))
+		}(idx, i)
+	}
+	wg.Wait()
+
+	failures := 0
+	for idx, i := range instances {
+		if errs[idx] != nil {
+			log.Printf("Could not read log of instance %d on node %s: %v", i.ID, i.Hostname, errs[idx])
+			failures++
+			continue
+		}
+		filter, _ := newLogFilter(options.Since, options.Grep)
+		for _, line := range strings.Split(strings.TrimRight(outputs[idx], "\n"), "\n") {
+			if line != "" && filter.match(line) {
+				printLine(i, line)
+			}
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("Failed to read logs of %d/%d instances", failures, len(instances))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package commands
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLineTime(t *testing.T) {
+	local := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	tests := []struct {
+		line string
+		ok   bool
+		t    time.Time
+	}{
+		{"2020/01/02 03:04:05 starting server", true, local},
+		{"2020-01-02 03:04:05 starting server", true, local},
+		{"2020-01-02T03:04:05 starting server", true, local},
+		{"2020-01-02T03:04:05.5Z starting server", true, time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.UTC)},
+		{"2020-01-02T03:04:05+02:00", true, time.Date(2020, 1, 2, 1, 4, 5, 0, time.UTC)},
+		{"\tat main.main()", false, time.Time{}},
+		{"2020/01/02", false, time.Time{}},
+		{"", false, time.Time{}},
+	}
+	for _, test := range tests {
+		got, ok := lineTime(test.line)
+		if ok != test.ok || !got.Equal(test.t) {
+			t.Errorf("lineTime(%q) = %s, %v, expected %s, %v", test.line, got, ok, test.t, test.ok)
+		}
+	}
+}
+
+func TestLogFilterSince(t *testing.T) {
+	f, err := newLogFilter(time.Hour, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour * 2).Format("2006/01/02 15:04:05")
+	recent := time.Now().Add(-time.Minute).Format("2006/01/02 15:04:05")
+
+	// lines without a timestamp go with the last line that had one
+	lines := []struct {
+		line  string
+		shown bool
+	}{
+		{"no timestamp before any", true},
+		{old + " panic: old", false},
+		{"\tat old.trace()", false},
+		{recent + " panic: recent", true},
+		{"\tat recent.trace()", true},
+	}
+	for _, l := range lines {
+		if shown := f.match(l.line); shown != l.shown {
+			t.Errorf("match(%q) = %v, expected %v", l.line, shown, l.shown)
+		}
+	}
+}
+
+func TestLogFilterGrep(t *testing.T) {
+	f, err := newLogFilter(0, "err(or)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for line, shown := range map[string]bool{"an error": true, "err": true, "all good": false} {
+		if f.match(line) != shown {
+			t.Errorf("match(%q) = %v, expected %v", line, !shown, shown)
+		}
+	}
+
+	if _, err := newLogFilter(0, "("); err == nil {
+		t.Error("Expected an error for a malformed grep pattern")
+	}
+}
+
+func TestLogsCmd(t *testing.T) {
+	tests := []struct {
+		lines  int
+		follow bool
+		cmd    string
+	}{
+		{50, false, "tail -n 50 ~/logs/instance_3.log"},
+		{0, false, "tail -n +1 ~/logs/instance_3.log"},
+		{10, true, "tail -n 10 -F ~/logs/instance_3.log"},
+	}
+	for _, test := range tests {
+		if cmd := logsCmd(3, test.lines, test.follow); cmd != test.cmd {
+			t.Errorf("logsCmd(3, %d, %v) = %s, expected %s", test.lines, test.follow, cmd, test.cmd)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package commands
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// directory in the plcli data dir holding one manifest per deployment
+const deploymentsDir = "deployments"
+
+// states of a deployment
+const (
+	deploymentInProgress = "in-progress"
+	deploymentComplete   = "complete"
+	deploymentFailed     = "failed"
+	deploymentRolledBack = "rolled-back"
+)
+
+// states of a node in a deployment, a node that fails a step stays in the state it was in and gets an error
+const (
+	nodePending      = "pending"
+	nodeBootstrapped = "bootstrapped"
+	nodeLaunched     = "launched"
+)
+
+// deploymentNode is a node used in a deployment
+type deploymentNode struct {
+	Hostname string `json:"hostname"`
+	NodeID   int    `json:"node_id"`
+	Role     string `json:"role,omitempty"`
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// deploymentInstance is an app instance launched on a node
+type deploymentInstance struct {
+	ID        int            `json:"id"`
+	Hostname  string         `json:"hostname"`
+	NodeID    int            `json:"node_id"`
+	NodeIndex int            `json:"node_index"`
+	Role      string         `json:"role,omitempty"`
+	Port      int            `json:"port,omitempty"`
+	Ports     map[string]int `json:"ports,omitempty"`
+}
+
+// instanceEnv returns the env vars identifying an instance, PLCLI_INSTANCE_ID, PLCLI_PORT and PLCLI_PORT_<NAME>
+func instanceEnv(i deploymentInstance) map[string]string {
+	env := map[string]string{"PLCLI_INSTANCE_ID": strconv.Itoa(i.ID)}
+	if i.Port > 0 {
+		env["PLCLI_PORT"] = strconv.Itoa(i.Port)
+	}
+	for name, port := range i.Ports {
+		env[fmt.Sprintf("PLCLI_PORT_%s", strings.ToUpper(name))] = strconv.Itoa(port)
+	}
+	return env
+}
+
+// deploymentManifest records what was deployed where, so that the deployment can be managed after plcli deploy returns
+type deploymentManifest struct {
+	ID            string               `json:"id"`
+	Slice         string               `json:"slice"`
+	GitURL        string               `json:"git_url"`
+	Branch        string               `json:"branch"`
+	Commit        string               `json:"commit"`
+	Source        string               `json:"source,omitempty"`
+	Archive       string               `json:"archive,omitempty"`
+	Checksum      string               `json:"checksum,omitempty"`
+	Binary        *deployedBinary      `json:"binary,omitempty"`
+	AppPath       string               `json:"app_path"`
+	Sudo          bool                 `json:"sudo"`
+	Scale         int                  `json:"scale"`
+	Status        string               `json:"status,omitempty"`
+	Nodes         []deploymentNode     `json:"nodes"`
+	Spares        []deploymentNode     `json:"spares,omitempty"`
+	Dropped       []deploymentNode     `json:"dropped,omitempty"`
+	MinNodes      int                  `json:"min_nodes,omitempty"`
+	Instances     []deploymentInstance `json:"instances"`
+	Env           map[string]string    `json:"env"`
+	Artifacts     []string             `json:"artifacts,omitempty"`
+	PeerList      string               `json:"peer_list,omitempty"`
+	Addons        []addon              `json:"addons,omitempty"`
+	Supervisor    *supervisorConfig    `json:"supervisor,omitempty"`
+	LivenessProbe *probe               `json:"liveness_probe,omitempty"`
+	PreviousID    string               `json:"previous_id,omitempty"`
+	StartedAt     time.Time            `json:"started_at"`
+	FinishedAt    time.Time            `json:"finished_at"`
+}
+
+// newDeploymentID returns an ID for a deployment started now
+func newDeploymentID() string {
+	// the random suffix keeps deployments started in the same second apart
+	suffix := make([]byte, 2)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), hex.EncodeToString(suffix))
+}
+
+// newDeploymentManifest creates a manifest for a deployment started now
+func newDeploymentManifest(gitURL string, commit string, options *util.Options) *deploymentManifest {
+	return &deploymentManifest{
+		ID:        newDeploymentID(),
+		Slice:     options.Slice,
+		GitURL:    gitURL,
+		Branch:    options.GitBranch,
+		Commit:    commit,
+		AppPath:   options.AppPath,
+		Sudo:      options.Sudo,
+		Scale:     options.Scale,
+		Status:    deploymentInProgress,
+		StartedAt: time.Now(),
+	}
+}
+
+// setNodes records the nodes used in the deployment
+func (m *deploymentManifest) setNodes(nodes []pl.Node) {
+	m.Nodes = []deploymentNode{}
+	for _, n := range nodes {
+		m.Nodes = append(m.Nodes, deploymentNode{Hostname: n.HostName, NodeID: n.NodeID, State: nodePending})
+	}
+}
+
+// origin describes where the deployed app comes from
+func (m *deploymentManifest) origin() string {
+	if m.Archive != "" {
+		return m.Source
+	}
+	return m.GitURL
+}
+
+// version describes the deployed version of the app, its commit or the checksum of its archive
+func (m *deploymentManifest) version() string {
+	if m.Archive != "" {
+		return fmt.Sprintf("archive %.8s", m.Checksum)
+	}
+	return fmt.Sprintf("commit %.8s", m.Commit)
+}
+
+// loadConf parses the .plcli.yml of the deployed app
+func (m *deploymentManifest) loadConf() *plcliYmlFile {
+	if m.Archive != "" {
+		return parseArchiveYML(m.Archive)
+	}
+	conf, _ := parseYML(m.GitURL, m.Commit)
+	return conf
+}
+
+// setSpares records the nodes that may replace nodes that fail to bootstrap, best first
+func (m *deploymentManifest) setSpares(nodes []pl.Node) {
+	m.Spares = []deploymentNode{}
+	for _, n := range nodes {
+		m.Spares = append(m.Spares, deploymentNode{Hostname: n.HostName, NodeID: n.NodeID, State: nodePending})
+	}
+}
+
+// replaceNode swaps a node of the deployment for the next spare node, which takes over its instances. Returns
+// false if there are no spare nodes left.
+func (m *deploymentManifest) replaceNode(hostname string) (pl.Node, bool) {
+	if len(m.Spares) == 0 {
+		return pl.Node{}, false
+	}
+	spare := m.Spares[0]
+	m.Spares = m.Spares[1:]
+
+	for i, n := range m.Nodes {
+		if n.Hostname == hostname {
+			m.Dropped = append(m.Dropped, n)
+			spare.Role = n.Role
+			m.Nodes[i] = spare
+		}
+	}
+	for i := range m.Instances {
+		if m.Instances[i].Hostname == hostname {
+			m.Instances[i].Hostname = spare.Hostname
+			m.Instances[i].NodeID = spare.NodeID
+		}
+	}
+
+	return pl.Node{HostName: spare.Hostname, NodeID: spare.NodeID}, true
+}
+
+// dropNode removes a node and its instances from the deployment
+func (m *deploymentManifest) dropNode(hostname string) {
+	nodes := []deploymentNode{}
+	for _, n := range m.Nodes {
+		if n.Hostname == hostname {
+			m.Dropped = append(m.Dropped, n)
+		} else {
+			nodes = append(nodes, n)
+		}
+	}
+	m.Nodes = nodes
+
+	instances := []deploymentInstance{}
+	for _, i := range m.Instances {
+		if i.Hostname != hostname {
+			instances = append(instances, i)
+		}
+	}
+	m.Instances = instances
+}
+
+// setNodeState records the state a node reached, along with the error that kept it from reaching the next one
+func (m *deploymentManifest) setNodeState(hostname string, state string, err error) {
+	for i := range m.Nodes {
+		if m.Nodes[i].Hostname == hostname {
+			m.Nodes[i].State = state
+			m.Nodes[i].Error = ""
+			if err != nil {
+				m.Nodes[i].Error = err.Error()
+			}
+		}
+	}
+}
+
+// nodesInState returns the nodes of the deployment that are in the given state
+func (m *deploymentManifest) nodesInState(state string) []pl.Node {
+	nodes := []pl.Node{}
+	for _, n := range m.Nodes {
+		if n.State == state {
+			nodes = append(nodes, pl.Node{HostName: n.Hostname, NodeID: n.NodeID})
+		}
+	}
+	return nodes
+}
+
+// plNodes returns the nodes of the deployment
+func (m *deploymentManifest) plNodes() []pl.Node {
+	nodes := []pl.Node{}
+	for _, n := range m.Nodes {
+		nodes = append(nodes, pl.Node{HostName: n.Hostname, NodeID: n.NodeID})
+	}
+	return nodes
+}
+
+// touchedNodes returns the nodes of the deployment along with the nodes it dropped after they failed
+func (m *deploymentManifest) touchedNodes() []pl.Node {
+	nodes := m.plNodes()
+	for _, n := range m.Dropped {
+		nodes = append(nodes, pl.Node{HostName: n.Hostname, NodeID: n.NodeID})
+	}
+	return nodes
+}
+
+// instancesByHostname groups the instances of the deployment by the node they run on
+func (m *deploymentManifest) instancesByHostname() map[string][]deploymentInstance {
+	byHostname := map[string][]deploymentInstance{}
+	for _, i := range m.Instances {
+		byHostname[i.Hostname] = append(byHostname[i.Hostname], i)
+	}
+	return byHostname
+}
+
+func deploymentsPath() (string, error) {
+	dir, err := util.DataDirPath()
+	if err != nil {
+		return "", err
+	}
+
+	path := fmt.Sprintf("%s/%s", dir, deploymentsDir)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// writeManifest stores the manifest in the plcli data dir, replacing any previous version of it
+func writeManifest(m *deploymentManifest) error {
+	dir, err := deploymentsPath()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return util.WriteFileAtomic(fmt.Sprintf("%s/%s.json", dir, m.ID), data, 0644)
+}
+
+// listDeploymentIDs returns the IDs of all stored deployments, oldest first
+func listDeploymentIDs() ([]string, error) {
+	dir, err := deploymentsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(f.Name(), ".json"))
+		}
+	}
+	// ids start with a timestamp, so lexical order is chronological order
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// loadManifest reads the manifest of the deployment with the given ID, or of the latest deployment if id is empty
+func loadManifest(id string) (*deploymentManifest, error) {
+	if id == "" {
+		ids, err := listDeploymentIDs()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			return nil, errors.New("No deployments found, deploy an app first")
+		}
+		id = ids[len(ids)-1]
+	}
+
+	dir, err := deploymentsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.json", dir, id))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("No deployment with ID %s found", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	m := deploymentManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("Malformed manifest for deployment %s: %v", id, err)
+	}
+	return &m, nil
+}
+
+// latestDeployment returns the latest deployment on a slice that completed, or nil if there is none
+func latestDeployment(sliceName string) *deploymentManifest {
+	ids, err := listDeploymentIDs()
+	if err != nil {
+		return nil
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		m, err := loadManifest(ids[i])
+		if err != nil || m.Slice != sliceName {
+			continue
+		}
+		if m.Status == deploymentComplete {
+			return m
+		}
+	}
+	return nil
+}
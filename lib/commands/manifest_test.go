@@ -0,0 +1,50 @@
+package commands
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mitchellh/go-homedir"
+)
+
+// useTempHome points the plcli data dir at a temp dir for the duration of a test
+func useTempHome(t *testing.T) {
+	home := os.Getenv("HOME")
+	homedir.DisableCache = true
+	os.Setenv("HOME", t.TempDir())
+	t.Cleanup(func() { os.Setenv("HOME", home) })
+}
+
+func TestLatestDeployment(t *testing.T) {
+	useTempHome(t)
+
+	if m := latestDeployment("slice"); m != nil {
+		t.Errorf("Found deployment %s without any deployments", m.ID)
+	}
+
+	manifests := []deploymentManifest{
+		{ID: "20200101-000000-aaaa", Slice: "slice", Status: deploymentComplete},
+		{ID: "20200102-000000-aaaa", Slice: "slice", Status: deploymentComplete},
+		{ID: "20200103-000000-aaaa", Slice: "other", Status: deploymentComplete},
+		{ID: "20200104-000000-aaaa", Slice: "slice", Status: deploymentFailed},
+		{ID: "20200105-000000-aaaa", Slice: "slice", Status: deploymentRolledBack},
+		{ID: "20200106-000000-aaaa", Slice: "slice", Status: deploymentInProgress},
+		{ID: "20200107-000000-aaaa", Slice: "slice"},
+	}
+	for i := range manifests {
+		if err := writeManifest(&manifests[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// only completed deployments of the slice count, the latest of them by ID
+	if m := latestDeployment("slice"); m == nil || m.ID != "20200102-000000-aaaa" {
+		t.Errorf("Latest deployment of slice is %v, expected 20200102-000000-aaaa", m)
+	}
+	if m := latestDeployment("other"); m == nil || m.ID != "20200103-000000-aaaa" {
+		t.Errorf("Latest deployment of other is %v, expected 20200103-000000-aaaa", m)
+	}
+	if m := latestDeployment("unknown"); m != nil {
+		t.Errorf("Found deployment %s of a slice without deployments", m.ID)
+	}
+}
@@ -0,0 +1,220 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/axelniklasson/plcli/lib/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+// name of the datasource the generated Grafana dashboard queries
+const grafanaDatasource = "Prometheus"
+
+// prometheusConfig is the part of a prometheus.yml plcli generates
+type prometheusConfig struct {
+	Global struct {
+		ScrapeInterval string `yaml:"scrape_interval"`
+	} `yaml:"global"`
+	ScrapeConfigs []scrapeConfig `yaml:"scrape_configs"`
+}
+
+type scrapeConfig struct {
+	JobName        string          `yaml:"job_name"`
+	FileSDConfigs  []fileSDConfig  `yaml:"file_sd_configs"`
+	RelabelConfigs []relabelConfig `yaml:"relabel_configs"`
+}
+
+type fileSDConfig struct {
+	Files []string `yaml:"files"`
+}
+
+type relabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,omitempty"`
+	Regex        string   `yaml:"regex,omitempty"`
+	TargetLabel  string   `yaml:"target_label,omitempty"`
+	Replacement  string   `yaml:"replacement,omitempty"`
+	Action       string   `yaml:"action,omitempty"`
+}
+
+// prometheusScrapeConfigs builds a scrape config per job reading the targets of the job from the sd file. The
+// hostname is taken from the target address and used as instance, suffixed with the instance ID of app instances.
+func prometheusScrapeConfigs(jobs []sdJob, sdPath string) []scrapeConfig {
+	configs := []scrapeConfig{}
+	for _, j := range jobs {
+		configs = append(configs, scrapeConfig{
+			JobName:       j.Name,
+			FileSDConfigs: []fileSDConfig{{Files: []string{sdPath}}},
+			RelabelConfigs: []relabelConfig{
+				{SourceLabels: []string{"job"}, Regex: j.Name, Action: "keep"},
+				{SourceLabels: []string{"__address__"}, Regex: `(.+):\d+`, TargetLabel: "hostname", Replacement: "$1"},
+				{SourceLabels: []string{"hostname"}, TargetLabel: "instance"},
+				{SourceLabels: []string{"hostname", "instance_id"}, Regex: `(.+);(\d+)`, TargetLabel: "instance", Replacement: "$1/$2"},
+			},
+		})
+	}
+	return configs
+}
+
+// grafanaPanel builds a time series panel of a query, one series per legend
+func grafanaPanel(id int, title string, expr string, legend string, unit string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         id,
+		"type":       "timeseries",
+		"title":      title,
+		"datasource": grafanaDatasource,
+		"gridPos":    map[string]int{"h": 8, "w": 12, "x": (id - 1) % 2 * 12, "y": (id - 1) / 2 * 8},
+		"fieldConfig": map[string]interface{}{
+			"defaults":  map[string]string{"unit": unit},
+			"overrides": []interface{}{},
+		},
+		"targets": []map[string]string{{"expr": expr, "legendFormat": legend, "refId": "A"}},
+	}
+}
+
+// grafanaDashboard builds a dashboard of the node_exporter metrics of the nodes of a slice, filterable by site and
+// hostname
+func grafanaDashboard(sliceName string) map[string]interface{} {
+	sel := `job="node_exporter",site=~"$site",hostname=~"$hostname"`
+	variable := func(name string, query string) map[string]interface{} {
+		return map[string]interface{}{
+			"name":       name,
+			"type":       "query",
+			"datasource": grafanaDatasource,
+			"query":      query,
+			"refresh":    2,
+			"includeAll": true,
+			"multi":      true,
+			"current":    map[string]interface{}{"text": "All", "value": "$__all"},
+		}
+	}
+
+	return map[string]interface{}{
+		"uid":           "plcli-slice-nodes",
+		"title":         fmt.Sprintf("PlanetLab nodes of %s", sliceName),
+		"tags":          []string{"plcli", "planetlab"},
+		"timezone":      "browser",
+		"schemaVersion": 27,
+		"refresh":       "30s",
+		"time":          map[string]string{"from": "now-1h", "to": "now"},
+		"templating": map[string]interface{}{"list": []interface{}{
+			variable("site", `label_values(up{job="node_exporter"}, site)`),
+			variable("hostname", `label_values(up{job="node_exporter",site=~"$site"}, hostname)`),
+		}},
+		"panels": []interface{}{
+			grafanaPanel(1, "Nodes up", fmt.Sprintf("sum(up{%s})", sel), "up", "short"),
+			grafanaPanel(2, "Load (1m)", fmt.Sprintf("node_load1{%s}", sel), "{{hostname}}", "short"),
+			grafanaPanel(3, "CPU busy", fmt.Sprintf(`1 - avg by (hostname) (rate(node_cpu_seconds_total{%s,mode="idle"}[5m]))`, sel), "{{hostname}}", "percentunit"),
+			grafanaPanel(4, "Memory available", fmt.Sprintf("node_memory_MemAvailable_bytes{%s}", sel), "{{hostname}}", "bytes"),
+			grafanaPanel(5, "Network received", fmt.Sprintf(`sum by (hostname) (rate(node_network_receive_bytes_total{%s,device!="lo"}[5m]))`, sel), "{{hostname}}", "Bps"),
+			grafanaPanel(6, "Network transmitted", fmt.Sprintf(`sum by (hostname) (rate(node_network_transmit_bytes_total{%s,device!="lo"}[5m]))`, sel), "{{hostname}}", "Bps"),
+		},
+	}
+}
+
+// writeMonitorFile writes data to path in the monitoring dir, creating the dirs leading up to it
+func writeMonitorFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(path, data, 0644); err != nil {
+		return err
+	}
+	log.Printf("Wrote %s", path)
+	return nil
+}
+
+// MonitorUp writes the service discovery file of a deployment together with a Prometheus config scraping every
+// job in it to options.MonitorDir, and with options.Grafana a Grafana datasource and dashboard. The prometheus and
+// grafana dirs are meant to be mounted at /etc/prometheus and /etc/grafana of locally run containers.
+func MonitorUp(deploymentID string, options *util.Options) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+	conf := *m.loadConf()
+	conf.ServiceDiscovery.Format = sdPrometheus
+
+	// prometheus resolves relative sd paths against the dir of its config. An sd file elsewhere has its dir mounted
+	// at /etc/prometheus/sd, a mount of the file itself would go stale once the file is replaced.
+	promDir := filepath.Join(options.MonitorDir, "prometheus")
+	sdPath, sdRef, sdMount := filepath.Join(promDir, "sd.json"), "sd.json", ""
+	if options.PrometheusSDPath != "" {
+		sdPath, sdRef = options.PrometheusSDPath, "sd/"+filepath.Base(options.PrometheusSDPath)
+		sdDir, err := filepath.Abs(filepath.Dir(options.PrometheusSDPath))
+		if err != nil {
+			return err
+		}
+		sdMount = fmt.Sprintf(" -v %s:/etc/prometheus/sd", sdDir)
+	}
+	if err := os.MkdirAll(filepath.Dir(sdPath), 0755); err != nil {
+		return err
+	}
+	sdOptions := *options
+	sdOptions.PrometheusSDPath = sdPath
+	if err := writeServiceDiscovery(m, &conf, &sdOptions); err != nil {
+		return err
+	}
+
+	prom := prometheusConfig{}
+	prom.Global.ScrapeInterval = fmt.Sprintf("%ds", int(options.ScrapeInterval.Seconds()))
+	prom.ScrapeConfigs = prometheusScrapeConfigs(conf.ServiceDiscovery.jobs(m.Addons), sdRef)
+	data, err := yaml.Marshal(prom)
+	if err != nil {
+		return err
+	}
+	if err := writeMonitorFile(filepath.Join(promDir, "prometheus.yml"), data); err != nil {
+		return err
+	}
+
+	if options.Grafana {
+		grafanaDir := filepath.Join(options.MonitorDir, "grafana")
+		datasources := map[string]interface{}{
+			"apiVersion": 1,
+			"datasources": []map[string]interface{}{
+				{"name": grafanaDatasource, "type": "prometheus", "access": "proxy", "url": options.PrometheusURL, "isDefault": true},
+			},
+		}
+		providers := map[string]interface{}{
+			"apiVersion": 1,
+			"providers": []map[string]interface{}{
+				{"name": "plcli", "type": "file", "options": map[string]string{"path": "/etc/grafana/dashboards"}},
+			},
+		}
+
+		files := map[string]interface{}{
+			"provisioning/datasources/plcli.yml": datasources,
+			"provisioning/dashboards/plcli.yml":  providers,
+		}
+		for path, v := range files {
+			data, err := yaml.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := writeMonitorFile(filepath.Join(grafanaDir, path), data); err != nil {
+				return err
+			}
+		}
+
+		data, err := json.MarshalIndent(grafanaDashboard(m.Slice), "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeMonitorFile(filepath.Join(grafanaDir, "dashboards", "slice-nodes.json"), data); err != nil {
+			return err
+		}
+	}
+
+	abs, _ := filepath.Abs(options.MonitorDir)
+	fmt.Printf("\nMonitoring of deployment %s written to %s, run it with\n\n", m.ID, abs)
+	fmt.Printf("  docker run -d --name plcli-prometheus --network host -v %s/prometheus:/etc/prometheus%s prom/prometheus\n", abs, sdMount)
+	if options.Grafana {
+		fmt.Printf("  docker run -d --name plcli-grafana --network host -v %s/grafana/provisioning:/etc/grafana/provisioning "+
+			"-v %s/grafana/dashboards:/etc/grafana/dashboards grafana/grafana\n", abs, abs)
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+
+	"gopkg.in/yaml.v3"
+)
+
+// where the peer list is written in the app dir on every node, unless .plcli.yml says otherwise
+const defaultPeerListDest = "hosts.txt"
+
+// local copy of the peer list of the latest deployment
+const localPeerListPath = "./hosts_deployment.txt"
+
+// formats the peer list can be rendered in
+var peerListFormats = map[string]bool{"csv": true, "json": true, "yaml": true, "template": true}
+
+// peer is an app instance as listed in the peer list of a deployment
+type peer struct {
+	ID        int    `json:"id" yaml:"id"`
+	Hostname  string `json:"hostname" yaml:"hostname"`
+	IP        string `json:"ip" yaml:"ip"`
+	Port      int    `json:"port,omitempty" yaml:"port,omitempty"`
+	NodeIndex int    `json:"node_index" yaml:"node_index"`
+	Role      string `json:"role,omitempty" yaml:"role,omitempty"`
+}
+
+// peerList configures how the peer list written to every node looks. The csv format has an "id,hostname,ip" line
+// per instance, json and yaml list all fields of every peer and template renders a Go text/template in the repo
+// with the list of peers.
+type peerList struct {
+	Format   string `yaml:"format"`
+	Template string `yaml:"template"`
+	Dest     string `yaml:"dest"`
+
+	tmpl *template.Template
+}
+
+// validate checks the peer list config for errors and parses its template from dir
+func (p *peerList) validate(dir string, add func(msg string, path ...interface{})) {
+	if p.Format != "" && !peerListFormats[p.Format] {
+		add(fmt.Sprintf("peer list format %s is not one of csv, json, yaml and template", p.Format), "peers", "format")
+	}
+	if filepath.IsAbs(p.Dest) {
+		add("peer list dest must be a path within the app dir", "peers", "dest")
+	}
+
+	if p.Format != "template" {
+		if p.Template != "" {
+			add("template is only used with the template format", "peers", "template")
+		}
+		return
+	}
+	if p.Template == "" {
+		add("the template format needs a template", "peers", "format")
+		return
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, p.Template))
+	if err != nil {
+		add(fmt.Sprintf("template %s can't be read: %v", p.Template, err), "peers", "template")
+		return
+	}
+	p.tmpl, err = template.New(p.Template).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		add(fmt.Sprintf("template %s: %v", p.Template, err), "peers", "template")
+	}
+}
+
+// dest returns the path of the peer list in the app dir
+func (p *peerList) dest() string {
+	if p.Dest == "" {
+		return defaultPeerListDest
+	}
+	return p.Dest
+}
+
+// render renders the peer list in its configured format
+func (p *peerList) render(peers []peer) ([]byte, error) {
+	switch p.Format {
+	case "json":
+		return json.MarshalIndent(peers, "", "  ")
+	case "yaml":
+		return yaml.Marshal(peers)
+	case "template":
+		buf := bytes.Buffer{}
+		err := p.tmpl.Execute(&buf, peers)
+		return buf.Bytes(), err
+	default:
+		buf := bytes.Buffer{}
+		for _, peer := range peers {
+			buf.WriteString(fmt.Sprintf("%d,%s,%s\n", peer.ID, peer.Hostname, peer.IP))
+		}
+		return buf.Bytes(), nil
+	}
+}
+
+// resolveIP returns the address of a host, preferring IPv4 over IPv6
+func resolveIP(hostname string) (string, error) {
+	ips, err := net.LookupIP(hostname)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("No addresses found for %s", hostname)
+	}
+
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			return v4.String(), nil
+		}
+	}
+	return ips[0].String(), nil
+}
+
+// buildPeers lists the instances of a deployment, resolving the address of each node with instances once
+func buildPeers(m *deploymentManifest) ([]peer, error) {
+	ips := map[string]string{}
+	peers := []peer{}
+	for _, i := range m.Instances {
+		if _, ok := ips[i.Hostname]; !ok {
+			ip, err := resolveIP(i.Hostname)
+			if err != nil {
+				return nil, err
+			}
+			ips[i.Hostname] = ip
+		}
+		peers = append(peers, peer{i.ID, i.Hostname, ips[i.Hostname], i.Port, i.NodeIndex, i.Role})
+	}
+	return peers, nil
+}
+
+// peerListError lists the nodes a peer list could not be written to
+type peerListError struct {
+	failed []string
+}
+
+func (e *peerListError) Error() string {
+	return fmt.Sprintf("Could not write peer list to nodes %v", e.failed)
+}
+
+// transferPeerList renders the peer list of a deployment and writes it to the app dir of every node in targets,
+// replacing any previous peer list at once. If some nodes fail, the error is a *peerListError listing them.
+func transferPeerList(m *deploymentManifest, conf *plcliYmlFile, targets []pl.Node, options *util.Options) error {
+	peers, err := buildPeers(m)
+	if err != nil {
+		return err
+	}
+	data, err := conf.Peers.render(peers)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile("", "plcli-peers-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	dest := fmt.Sprintf("%s/%s", options.AppPath, conf.Peers.dest())
+	failed := []string{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, n := range targets {
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+			err := ExecCmdOnNode(options.Slice, hostname, fmt.Sprintf("mkdir -p %s", filepath.Dir(dest)), false)
+			if err == nil {
+				err = Transfer(options.Slice, hostname, f.Name(), dest+".tmp")
+			}
+			if err == nil {
+				err = ExecCmdOnNode(options.Slice, hostname, fmt.Sprintf("mv -f %s.tmp %s", dest, dest), false)
+			}
+			if err != nil {
+				log.Printf("Writing peer list to node %s failed: %v", hostname, err)
+				mux.Lock()
+				failed = append(failed, hostname)
+				mux.Unlock()
+			}
+		}(n.HostName)
+	}
+	wg.Wait()
+	if len(failed) > 0 {
+		return &peerListError{failed}
+	}
+
+	if !options.SkipWriteHostsFile {
+		if err := util.WriteFileAtomic(localPeerListPath, data, 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
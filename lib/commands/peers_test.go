@@ -0,0 +1,111 @@
+package commands
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBuildPeers(t *testing.T) {
+	m := &deploymentManifest{Instances: []deploymentInstance{
+		{ID: 0, Hostname: "127.0.0.2", NodeIndex: 0, Port: 2112, Role: "server"},
+		{ID: 1, Hostname: "127.0.0.2", NodeIndex: 0, Port: 2113, Role: "server"},
+		{ID: 2, Hostname: "::1", NodeIndex: 1, Port: 2114},
+	}}
+	peers, err := buildPeers(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []peer{
+		{0, "127.0.0.2", "127.0.0.2", 2112, 0, "server"},
+		{1, "127.0.0.2", "127.0.0.2", 2113, 0, "server"},
+		{2, "::1", "::1", 2114, 1, ""},
+	}
+	if !reflect.DeepEqual(peers, expected) {
+		t.Errorf("Built peers %+v, expected %+v", peers, expected)
+	}
+
+	m.Instances = append(m.Instances, deploymentInstance{ID: 3, Hostname: "bad..hostname"})
+	if _, err := buildPeers(m); err == nil {
+		t.Error("Expected an error for a hostname that doesn't resolve")
+	}
+}
+
+var testPeers = []peer{{0, "a.example.org", "10.0.0.1", 2112, 0, "server"}, {1, "b.example.org", "10.0.0.2", 0, 1, ""}}
+
+func TestRenderPeerList(t *testing.T) {
+	csv, err := (&peerList{}).render(testPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(csv) != "0,a.example.org,10.0.0.1\n1,b.example.org,10.0.0.2\n" {
+		t.Errorf("Rendered csv %q", csv)
+	}
+
+	data, err := (&peerList{Format: "json"}).render(testPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromJSON := []peer{}
+	if err := json.Unmarshal(data, &fromJSON); err != nil || !reflect.DeepEqual(fromJSON, testPeers) {
+		t.Errorf("Rendered json %s", data)
+	}
+
+	data, err = (&peerList{Format: "yaml"}).render(testPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromYAML := []peer{}
+	if err := yaml.Unmarshal(data, &fromYAML); err != nil || !reflect.DeepEqual(fromYAML, testPeers) {
+		t.Errorf("Rendered yaml %s", data)
+	}
+}
+
+func TestRenderPeerListTemplate(t *testing.T) {
+	dir := t.TempDir()
+	tmpl := "{{range .}}{{.Hostname}}:{{.Port}}\n{{end}}"
+	if err := ioutil.WriteFile(filepath.Join(dir, "peers.tmpl"), []byte(tmpl), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &peerList{Format: "template", Template: "peers.tmpl"}
+	p.validate(dir, func(msg string, path ...interface{}) { t.Errorf("Unexpected validation error %s", msg) })
+	data, err := p.render(testPeers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "a.example.org:2112\nb.example.org:0\n" {
+		t.Errorf("Rendered template %q", data)
+	}
+}
+
+func TestValidatePeerList(t *testing.T) {
+	tests := []struct {
+		list peerList
+		errs int
+	}{
+		{peerList{}, 0},
+		{peerList{Format: "yaml", Dest: "conf/peers.yml"}, 0},
+		{peerList{Format: "xml"}, 1},
+		{peerList{Dest: "/etc/hosts"}, 1},
+		{peerList{Format: "template"}, 1},
+		{peerList{Format: "csv", Template: "peers.tmpl"}, 1},
+		{peerList{Format: "template", Template: "missing.tmpl"}, 1},
+	}
+	for _, test := range tests {
+		msgs := []string{}
+		test.list.validate(t.TempDir(), func(msg string, path ...interface{}) { msgs = append(msgs, msg) })
+		if len(msgs) != test.errs {
+			t.Errorf("Validating %+v gave %v, expected %d errors", test.list, msgs, test.errs)
+		}
+	}
+
+	if dest := (&peerList{}).dest(); dest != defaultPeerListDest {
+		t.Errorf("Default dest is %s, expected %s", dest, defaultPeerListDest)
+	}
+}
@@ -0,0 +1,568 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+
+	"gopkg.in/yaml.v3"
+)
+
+// name of the file describing how an app is bootstrapped and launched
+const plcliYmlFileName = ".plcli.yml"
+
+type plcliYmlFile struct {
+	BootstrapCmds    []string          `yaml:"bootstrap_cmds"`
+	Env              map[string]string `yaml:"env"`
+	LaunchCmds       []string          `yaml:"launch_cmds"`
+	Roles            []role            `yaml:"roles"`
+	Port             portAllocation    `yaml:"port"`
+	Ports            map[string]int    `yaml:"ports"`
+	ReadinessProbe   *probe            `yaml:"readiness_probe"`
+	LivenessProbe    *probe            `yaml:"liveness_probe"`
+	Hooks            hooks             `yaml:"hooks"`
+	Templates        []fileTemplate    `yaml:"templates"`
+	Artifacts        []string          `yaml:"artifacts"`
+	Build            *build            `yaml:"build"`
+	Peers            peerList          `yaml:"peers"`
+	ServiceDiscovery serviceDiscovery  `yaml:"service_discovery"`
+	Addons           []addon           `yaml:"addons"`
+	Supervisor       *supervisorConfig `yaml:"supervisor"`
+}
+
+// role is a group of nodes running their own launch commands and number of instances. Nodes not covered by any
+// role run the top-level launch commands.
+type role struct {
+	Name       string            `yaml:"name"`
+	Nodes      int               `yaml:"nodes"`
+	Scale      int               `yaml:"scale"`
+	LaunchCmds []string          `yaml:"launch_cmds"`
+	Env        map[string]string `yaml:"env"`
+}
+
+// probe is a command run on a node, in the app dir with PLCLI_INSTANCE_ID exported, that succeeds once an
+// instance is ready or while it is alive
+type probe struct {
+	Cmd      string        `yaml:"cmd" json:"cmd"`
+	Timeout  time.Duration `yaml:"timeout" json:"timeout"`
+	Interval time.Duration `yaml:"interval" json:"interval"`
+}
+
+// portAllocation gives every instance its own port, base + instance ID * stride. Named ports are offset the same way.
+type portAllocation struct {
+	Base   int  `yaml:"base"`
+	Stride *int `yaml:"stride"`
+}
+
+// default port allocation of apps that don't configure it
+const (
+	defaultBasePort   = 2112
+	defaultPortStride = 1
+)
+
+// forInstance returns the port of an instance, offset from base
+func (p portAllocation) forInstance(base int, instanceID int) int {
+	stride := defaultPortStride
+	if p.Stride != nil {
+		stride = *p.Stride
+	}
+	return base + instanceID*stride
+}
+
+// basePort returns the port of the first instance
+func (p portAllocation) basePort() int {
+	if p.Base == 0 {
+		return defaultBasePort
+	}
+	return p.Base
+}
+
+// hooks are commands run locally, before any node is touched and once all instances are launched
+type hooks struct {
+	PreDeploy  []string `yaml:"pre_deploy"`
+	PostDeploy []string `yaml:"post_deploy"`
+}
+
+// fileTemplate is a Go text/template in the repo that is rendered for every node and written to dest in the app dir
+type fileTemplate struct {
+	Src  string `yaml:"src"`
+	Dest string `yaml:"dest"`
+
+	tmpl *template.Template
+}
+
+// validationError is an error in a .plcli.yml file, Line is 0 if it is not known
+type validationError struct {
+	Line int
+	Msg  string
+}
+
+func (e validationError) Error() string {
+	if e.Line == 0 {
+		return e.Msg
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+var (
+	envNamePattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	typeErrorPrefix = regexp.MustCompile(`^line (\d+): `)
+)
+
+// yamlLine returns the line of the value at path in a yaml document, path elements being map keys or sequence
+// indices. If the path doesn't exist the line of its closest existing parent is returned.
+func yamlLine(doc *yaml.Node, path ...interface{}) int {
+	n := doc
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+
+	line := n.Line
+	for _, p := range path {
+		var next *yaml.Node
+		switch key := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == key {
+						next = n.Content[i+1]
+						line = n.Content[i].Line
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && key < len(n.Content) {
+				next = n.Content[key]
+				line = next.Line
+			}
+		}
+		if next == nil {
+			return line
+		}
+		n = next
+	}
+
+	return line
+}
+
+// loadYML reads and validates the .plcli.yml file at path, template sources are read relative to its directory.
+// Problems with the content of the file are returned as validation errors, err is only set if it can't be read.
+func loadYML(path string) (*plcliYmlFile, []validationError, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, fmt.Errorf("No %s found at %s", plcliYmlFileName, path)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	doc := yaml.Node{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, []validationError{{Msg: err.Error()}}, nil
+	}
+
+	conf := plcliYmlFile{}
+	errs := []validationError{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&conf)
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		for _, e := range typeErr.Errors {
+			errs = append(errs, parseTypeError(e))
+		}
+	} else if err != nil && err != io.EOF {
+		errs = append(errs, validationError{Msg: err.Error()})
+	}
+
+	errs = append(errs, conf.validate(&doc, filepath.Dir(path))...)
+	sort.Slice(errs, func(i, j int) bool {
+		if errs[i].Line != errs[j].Line {
+			return errs[i].Line < errs[j].Line
+		}
+		return errs[i].Msg < errs[j].Msg
+	})
+	return &conf, errs, nil
+}
+
+// parseTypeError turns a "line N: msg" error from the yaml decoder into a validation error
+func parseTypeError(e string) validationError {
+	match := typeErrorPrefix.FindStringSubmatch(e)
+	if match == nil {
+		return validationError{Msg: e}
+	}
+	line, _ := strconv.Atoi(match[1])
+	return validationError{Line: line, Msg: strings.TrimPrefix(e, match[0])}
+}
+
+// validate checks the parsed file for errors the yaml decoder can't catch and parses its templates from dir
+func (c *plcliYmlFile) validate(doc *yaml.Node, dir string) []validationError {
+	errs := []validationError{}
+	add := func(msg string, path ...interface{}) {
+		errs = append(errs, validationError{yamlLine(doc, path...), msg})
+	}
+	checkEnv := func(env map[string]string, path ...interface{}) {
+		for k := range env {
+			if !envNamePattern.MatchString(k) {
+				add(fmt.Sprintf("%s is not a valid env var name", k), append(path, k)...)
+			}
+		}
+	}
+
+	checkEnv(c.Env, "env")
+	if len(c.LaunchCmds) == 0 && len(c.Roles) == 0 {
+		add("launch_cmds is missing")
+	}
+
+	names := map[string]bool{}
+	remainderRoles := 0
+	for i, r := range c.Roles {
+		if r.Name == "" {
+			add("role has no name", "roles", i)
+		} else if names[r.Name] {
+			add(fmt.Sprintf("role %s is defined more than once", r.Name), "roles", i, "name")
+		}
+		names[r.Name] = true
+
+		if r.Nodes < 0 {
+			add("nodes can't be negative", "roles", i, "nodes")
+		} else if r.Nodes == 0 {
+			remainderRoles++
+		}
+		if r.Scale < 0 {
+			add("scale can't be negative", "roles", i, "scale")
+		}
+		if len(r.LaunchCmds) == 0 && len(c.LaunchCmds) == 0 {
+			add(fmt.Sprintf("role %s has no launch_cmds and there are no top-level launch_cmds", r.Name), "roles", i)
+		}
+		checkEnv(r.Env, "roles", i, "env")
+	}
+	if remainderRoles > 1 {
+		add("only one role can leave out nodes to take the remaining nodes", "roles")
+	}
+
+	if c.Port.Base < 0 || c.Port.Base > 65535 {
+		add(fmt.Sprintf("port base must be between 1 and 65535, or left out to start at %d", defaultBasePort), "port", "base")
+	}
+	// a stride of 0 would give every instance on a node the same port
+	if c.Port.Stride != nil && *c.Port.Stride < 1 {
+		add("port stride must be at least 1", "port", "stride")
+	}
+	for name, port := range c.Ports {
+		if !envNamePattern.MatchString(name) {
+			add(fmt.Sprintf("port name %s can only contain letters, digits and underscores", name), "ports", name)
+		}
+		if port < 1 || port > 65535 {
+			add(fmt.Sprintf("port %s must be between 1 and 65535", name), "ports", name)
+		}
+	}
+
+	probes := map[string]*probe{"readiness_probe": c.ReadinessProbe, "liveness_probe": c.LivenessProbe}
+	for name, p := range probes {
+		if p == nil {
+			continue
+		}
+		if p.Cmd == "" {
+			add(fmt.Sprintf("%s has no cmd", name), name)
+		}
+		if p.Timeout < 0 || p.Interval < 0 {
+			add(fmt.Sprintf("%s can't have a negative timeout or interval", name), name)
+		}
+	}
+
+	for i := range c.Templates {
+		t := &c.Templates[i]
+		if t.Src == "" || t.Dest == "" {
+			add("template needs both src and dest", "templates", i)
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, t.Src))
+		if err != nil {
+			add(fmt.Sprintf("template %s can't be read: %v", t.Src, err), "templates", i, "src")
+			continue
+		}
+		t.tmpl, err = template.New(t.Src).Option("missingkey=error").Parse(string(data))
+		if err != nil {
+			add(fmt.Sprintf("template %s: %v", t.Src, err), "templates", i, "src")
+		}
+	}
+
+	c.Build.validate(dir, add)
+	c.Peers.validate(dir, add)
+	c.ServiceDiscovery.validate(c.Ports, add)
+	validateAddons(c.Addons, add)
+	c.Supervisor.validate(add)
+
+	for i, a := range c.Artifacts {
+		if strings.TrimSpace(a) == "" {
+			add("artifact path is empty", "artifacts", i)
+		}
+	}
+
+	return errs
+}
+
+// assignRoles returns the role of each of nodeCount nodes. Roles with a node count take that many nodes in the
+// order they are listed, a role without one takes the remaining nodes and nodes left after that get the default
+// role "".
+func (c *plcliYmlFile) assignRoles(nodeCount int) ([]string, error) {
+	roles := []string{}
+	remainder := ""
+	for _, r := range c.Roles {
+		if r.Nodes == 0 {
+			remainder = r.Name
+		}
+		for i := 0; i < r.Nodes; i++ {
+			roles = append(roles, r.Name)
+		}
+	}
+	if len(roles) > nodeCount {
+		return nil, fmt.Errorf("Roles need %d nodes but the deployment has %d", len(roles), nodeCount)
+	}
+
+	for len(roles) < nodeCount {
+		if remainder == "" && len(c.LaunchCmds) == 0 {
+			return nil, fmt.Errorf("Roles cover %d of %d nodes and there are no top-level launch_cmds for the rest", len(roles), nodeCount)
+		}
+		roles = append(roles, remainder)
+	}
+	return roles, nil
+}
+
+// getRole returns the role with the given name, or nil for the default role
+func (c *plcliYmlFile) getRole(name string) *role {
+	for i := range c.Roles {
+		if c.Roles[i].Name == name {
+			return &c.Roles[i]
+		}
+	}
+	return nil
+}
+
+// roleScale returns the number of instances to run per node of a role
+func (c *plcliYmlFile) roleScale(name string, scale int) int {
+	if r := c.getRole(name); r != nil && r.Scale > 0 {
+		return r.Scale
+	}
+	return scale
+}
+
+// launchScript builds the launch script of an instance, role env taking precedence over env. The instance ID, its
+// node index, its ports and the number of instances in the deployment are exported as PLCLI_INSTANCE_ID,
+// PLCLI_NODE_INDEX, PLCLI_PORT, PLCLI_PORT_<NAME> and PLCLI_INSTANCE_COUNT.
+func (c *plcliYmlFile) launchScript(i deploymentInstance, instanceCount int, env map[string]string) string {
+	merged := map[string]string{}
+	for k, v := range env {
+		merged[k] = v
+	}
+
+	cmds := c.LaunchCmds
+	if r := c.getRole(i.Role); r != nil {
+		for k, v := range r.Env {
+			merged[k] = v
+		}
+		if len(r.LaunchCmds) > 0 {
+			cmds = r.LaunchCmds
+		}
+	}
+
+	for k, v := range instanceEnv(i) {
+		merged[k] = v
+	}
+	merged["PLCLI_NODE_INDEX"] = strconv.Itoa(i.NodeIndex)
+	merged["PLCLI_INSTANCE_COUNT"] = strconv.Itoa(instanceCount)
+
+	return buildLaunchScript(merged, cmds)
+}
+
+// checks that there is a valid .plcli.yml file in the repo at gitURL and parses it, also returns the sha of the
+// commit that gitBranch resolved to
+func parseYML(gitURL string, gitBranch string) (*plcliYmlFile, string) {
+	if !strings.HasSuffix(gitURL, ".git") {
+		log.Fatal(errors.New("Please provide a valid git url"))
+	}
+
+	cmd := fmt.Sprintf("rm -rf ./tmp && git clone %s ./tmp && cd ./tmp && git checkout %s", gitURL, gitBranch)
+	_, err := exec.Command("sh", "-c", cmd).Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// remove tmp dir
+	defer os.RemoveAll("./tmp")
+
+	conf, errs, err := loadYML(filepath.Join("./tmp", plcliYmlFileName))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(errs) > 0 {
+		for _, e := range errs {
+			log.Printf("%s: %s", plcliYmlFileName, e)
+		}
+		log.Fatalf("%s in %s has %d errors", plcliYmlFileName, gitURL, len(errs))
+	}
+
+	// resolve commit that will be deployed
+	out, err := exec.Command("git", "-C", "./tmp", "rev-parse", "HEAD").Output()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return conf, strings.TrimSpace(string(out))
+}
+
+// ValidateYML checks the .plcli.yml of an app and prints every error with its line number. target is either a
+// .plcli.yml file, a directory containing one or a git url, of which gitBranch is checked.
+func ValidateYML(target string, gitBranch string) error {
+	path := target
+	if strings.HasSuffix(target, ".git") {
+		dir, err := ioutil.TempDir("", "plcli")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+
+		out, err := exec.Command("sh", "-c", fmt.Sprintf("git clone %s %s && git -C %s checkout %s", target, dir, dir, gitBranch)).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("Could not clone %s: %v\n%s", target, err, out)
+		}
+		path = dir
+	}
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, plcliYmlFileName)
+	}
+
+	conf, errs, err := loadYML(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range errs {
+		fmt.Printf("%s: %s\n", path, e)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s has %d errors", path, len(errs))
+	}
+
+	fmt.Printf("%s is valid: %d roles, %d ports, %d templates, %d artifacts, builds go binary: %t\n", path, len(conf.Roles),
+		len(conf.Ports), len(conf.Templates), len(conf.Artifacts), conf.Build != nil && conf.Build.Go != nil)
+	return nil
+}
+
+// runHooks runs hook commands locally, with the deployment exported as PLCLI_DEPLOYMENT_ID, PLCLI_COMMIT,
+// PLCLI_SLICE and PLCLI_NODES
+func runHooks(name string, cmds []string, m *deploymentManifest) error {
+	hostnames := []string{}
+	for _, n := range m.Nodes {
+		hostnames = append(hostnames, n.Hostname)
+	}
+
+	for _, c := range cmds {
+		log.Printf("Running %s hook: %s", name, c)
+		cmd := exec.Command("sh", "-c", c)
+		cmd.Env = append(os.Environ(),
+			fmt.Sprintf("PLCLI_DEPLOYMENT_ID=%s", m.ID),
+			fmt.Sprintf("PLCLI_COMMIT=%s", m.Commit),
+			fmt.Sprintf("PLCLI_SLICE=%s", m.Slice),
+			fmt.Sprintf("PLCLI_NODES=%s", strings.Join(hostnames, " ")))
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q failed: %v", name, c, err)
+		}
+	}
+
+	return nil
+}
+
+// templateData is what file templates are rendered with for a node
+type templateData struct {
+	Deployment string
+	Commit     string
+	Hostname   string
+	NodeIndex  int
+	Role       string
+	Nodes      []string
+	Instances  []deploymentInstance
+	Env        map[string]string
+}
+
+// renderTemplates renders the file templates of an app for every target node and uploads them to its app dir
+func renderTemplates(m *deploymentManifest, conf *plcliYmlFile, targets []pl.Node) error {
+	if len(conf.Templates) == 0 || len(targets) == 0 {
+		return nil
+	}
+
+	dir, err := ioutil.TempDir("", "plcli")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	hostnames := []string{}
+	nodeIndex := map[string]int{}
+	for i, n := range m.Nodes {
+		hostnames = append(hostnames, n.Hostname)
+		nodeIndex[n.Hostname] = i
+	}
+	byHostname := m.instancesByHostname()
+
+	failed := []string{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, n := range targets {
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+			idx := nodeIndex[hostname]
+			data := templateData{m.ID, m.Commit, hostname, idx, m.Nodes[idx].Role, hostnames, byHostname[hostname], m.Env}
+
+			for i, t := range conf.Templates {
+				path := filepath.Join(dir, fmt.Sprintf("%s-%d", hostname, i))
+				err := renderTemplate(t, data, path)
+				if err == nil && filepath.Dir(t.Dest) != "." {
+					err = ExecCmdOnNode(m.Slice, hostname, fmt.Sprintf("mkdir -p %s/%s", m.AppPath, filepath.Dir(t.Dest)), false)
+				}
+				if err == nil {
+					err = Transfer(m.Slice, hostname, path, fmt.Sprintf("%s/%s", m.AppPath, t.Dest))
+				}
+				if err != nil {
+					log.Printf("Rendering template %s for node %s failed: %v", t.Src, hostname, err)
+					mux.Lock()
+					failed = append(failed, hostname)
+					mux.Unlock()
+					return
+				}
+			}
+		}(n.HostName)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not render templates for nodes %v", failed)
+	}
+	return nil
+}
+
+// renderTemplate renders a single template to a local file
+func renderTemplate(t fileTemplate, data templateData, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return t.tmpl.Execute(f, data)
+}
@@ -0,0 +1,159 @@
+package commands
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// loadTestYML writes a .plcli.yml with the given contents, and any other files, to a temp dir and loads it
+func loadTestYML(t *testing.T, contents string, files map[string]string) (*plcliYmlFile, []validationError) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(dir, plcliYmlFileName)
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, errs, err := loadYML(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf, errs
+}
+
+func TestLoadYMLValid(t *testing.T) {
+	conf, errs := loadTestYML(t, `
+bootstrap_cmds:
+  - make
+env:
+  LOG_LEVEL: debug
+roles:
+  - name: server
+    nodes: 1
+    launch_cmds:
+      - ./server
+  - name: client
+    scale: 2
+    launch_cmds:
+      - ./client
+port:
+  base: 3000
+  stride: 10
+ports:
+  metrics: 9000
+readiness_probe:
+  cmd: curl -sf localhost:$PLCLI_PORT
+hooks:
+  pre_deploy:
+    - echo starting
+templates:
+  - src: config.tmpl
+    dest: config.json
+`, map[string]string{"config.tmpl": `{"id": {{.Instance.ID}}}`})
+
+	if len(errs) > 0 {
+		t.Fatalf("Valid file has errors %v", errs)
+	}
+	if conf.Port.Base != 3000 || *conf.Port.Stride != 10 || conf.Ports["metrics"] != 9000 {
+		t.Errorf("Parsed ports %+v and %v", conf.Port, conf.Ports)
+	}
+	if conf.Templates[0].tmpl == nil {
+		t.Error("Template was not parsed")
+	}
+}
+
+func TestLoadYMLErrors(t *testing.T) {
+	_, errs := loadTestYML(t, `env:
+  1BAD: x
+roles:
+  - name: server
+    nodes: -1
+  - name: server
+    scale: -1
+  - nodes: 0
+port:
+  base: 70000
+  stride: 0
+ports:
+  bad-name: 0
+readiness_probe:
+  timeout: -1s
+templates:
+  - src: missing.tmpl
+    dest: out
+unknown: true
+`, nil)
+
+	expected := []validationError{
+		{2, "1BAD is not a valid env var name"},
+		{3, "only one role can leave out nodes to take the remaining nodes"},
+		{4, "role server has no launch_cmds and there are no top-level launch_cmds"},
+		{5, "nodes can't be negative"},
+		{6, "role server has no launch_cmds and there are no top-level launch_cmds"},
+		{6, "role server is defined more than once"},
+		{7, "scale can't be negative"},
+		{8, "role  has no launch_cmds and there are no top-level launch_cmds"},
+		{8, "role has no name"},
+		{10, "port base must be between 1 and 65535, or left out to start at 2112"},
+		{11, "port stride must be at least 1"},
+		{13, "port bad-name must be between 1 and 65535"},
+		{13, "port name bad-name can only contain letters, digits and underscores"},
+		{14, "readiness_probe can't have a negative timeout or interval"},
+		{14, "readiness_probe has no cmd"},
+		{17, "template missing.tmpl can't be read: open"},
+		{19, "field unknown not found in type commands.plcliYmlFile"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Got errors %v, expected %v", errs, expected)
+	}
+	for i, e := range expected {
+		got := errs[i]
+		// the message of a missing template goes on with its path in the temp dir
+		if strings.HasPrefix(e.Msg, "template missing.tmpl") {
+			got.Msg = strings.SplitN(got.Msg, " /", 2)[0]
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("Error %d is %v, expected %v", i, errs[i], e)
+		}
+	}
+}
+
+func TestLoadYMLLaunchCmdsMissing(t *testing.T) {
+	_, errs := loadTestYML(t, "bootstrap_cmds:\n  - make\n", nil)
+	if len(errs) != 1 || errs[0].Msg != "launch_cmds is missing" {
+		t.Errorf("Got errors %v, expected launch_cmds to be missing", errs)
+	}
+}
+
+func TestAssignRoles(t *testing.T) {
+	conf := &plcliYmlFile{Roles: []role{{Name: "server", Nodes: 1}, {Name: "client"}, {Name: "db", Nodes: 2}}}
+	roles, err := conf.assignRoles(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"server", "db", "db", "client", "client"}; !reflect.DeepEqual(roles, expected) {
+		t.Errorf("Assigned roles %v, expected %v", roles, expected)
+	}
+
+	if _, err := conf.assignRoles(2); err == nil {
+		t.Error("Expected an error when roles need more nodes than there are")
+	}
+
+	// nodes left without a remainder role get the default role, which needs top-level launch_cmds
+	conf = &plcliYmlFile{Roles: []role{{Name: "server", Nodes: 1}}}
+	if _, err := conf.assignRoles(2); err == nil {
+		t.Error("Expected an error without top-level launch_cmds for the remaining nodes")
+	}
+	conf.LaunchCmds = []string{"./app"}
+	if roles, err := conf.assignRoles(2); err != nil || !reflect.DeepEqual(roles, []string{"server", ""}) {
+		t.Errorf("Assigned roles %v, %v, expected server and the default role", roles, err)
+	}
+}
@@ -8,13 +8,17 @@ import (
 	"github.com/axelniklasson/plcli/lib/util"
 )
 
-// Provision provisions a set of nodes using a provided script
+// Provision provisions a set of nodes using a provided script, if any, and installs the addons in options.Addons
 func Provision(scriptPath string, hostnames []string, options *util.Options) error {
 	log.Printf("Initiaing provisioning of %d node(s)", len(hostnames))
 
-	if _, err := os.Stat(scriptPath); os.IsNotExist(err) {
+	if _, err := os.Stat(scriptPath); scriptPath != "" && os.IsNotExist(err) {
 		log.Fatalf("Could not find provision script at %s. Got error: %v", scriptPath, err)
 	}
+	addons, err := resolveAddons(nil, options)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	wg := sync.WaitGroup{}
 
@@ -24,27 +28,15 @@ func Provision(scriptPath string, hostnames []string, options *util.Options) err
 			log.Printf("Provision of node %s started by worker %d!", hostname, id)
 			defer wg.Done()
 
-			// transfer provision script to node
-			err := Transfer(options.Slice, hostname, scriptPath, "provision.sh")
-			if err != nil {
-				log.Printf("Could not transfer provision script to node %s. Error: %v", hostname, err)
+			if scriptPath != "" && !runProvisionScript(scriptPath, hostname, options) {
 				return
 			}
 
-			// run provision script on node
-			if options.Sudo {
-				err = ExecCmdOnNode(options.Slice, hostname, "cd; chmod +x provision.sh; sudo sh provision.sh", true)
-			} else {
-				err = ExecCmdOnNode(options.Slice, hostname, "cd; chmod +x provision.sh; sh provision.sh", true)
-			}
-			if err != nil {
-				log.Printf("Could not run provision script on node %s. Error: %v", hostname, err)
+			if err := installAddons(options.Slice, hostname, addons); err != nil {
+				log.Printf("Could not install addons on node %s. Error: %v", hostname, err)
 				return
 			}
 
-			// cleanup, remove provision script from node
-			err = ExecCmdOnNode(options.Slice, hostname, "cd; rm provision.sh", false)
-
 			log.Printf("Provision of node %s done!", hostname)
 		}(idx, n)
 	}
@@ -54,3 +46,28 @@ func Provision(scriptPath string, hostnames []string, options *util.Options) err
 
 	return nil
 }
+
+// runProvisionScript transfers a provision script to a node, runs it and removes it, returning whether it succeeded
+func runProvisionScript(scriptPath string, hostname string, options *util.Options) bool {
+	// transfer provision script to node
+	err := Transfer(options.Slice, hostname, scriptPath, "provision.sh")
+	if err != nil {
+		log.Printf("Could not transfer provision script to node %s. Error: %v", hostname, err)
+		return false
+	}
+
+	// run provision script on node
+	if options.Sudo {
+		err = ExecCmdOnNode(options.Slice, hostname, "cd; chmod +x provision.sh; sudo sh provision.sh", true)
+	} else {
+		err = ExecCmdOnNode(options.Slice, hostname, "cd; chmod +x provision.sh; sh provision.sh", true)
+	}
+	if err != nil {
+		log.Printf("Could not run provision script on node %s. Error: %v", hostname, err)
+		return false
+	}
+
+	// cleanup, remove provision script from node
+	ExecCmdOnNode(options.Slice, hostname, "cd; rm provision.sh", false)
+	return true
+}
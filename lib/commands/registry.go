@@ -0,0 +1,234 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// health of an instance as reported by the registry
+const (
+	instanceHealthy   = "healthy"
+	instanceUnhealthy = "unhealthy"
+	instanceStopped   = "stopped"
+	instanceUnknown   = "unknown"
+)
+
+// registryInstance is an app instance as listed by the registry
+type registryInstance struct {
+	ID        int            `json:"id"`
+	Hostname  string         `json:"hostname"`
+	IP        string         `json:"ip"`
+	Port      int            `json:"port,omitempty"`
+	Ports     map[string]int `json:"ports,omitempty"`
+	NodeIndex int            `json:"node_index"`
+	Role      string         `json:"role,omitempty"`
+	Health    string         `json:"health"`
+	Error     string         `json:"error,omitempty"`
+}
+
+// registrySnapshot is the state of a deployment served by the registry
+type registrySnapshot struct {
+	Deployment string             `json:"deployment"`
+	Slice      string             `json:"slice"`
+	Version    string             `json:"version"`
+	UpdatedAt  time.Time          `json:"updated_at"`
+	Instances  []registryInstance `json:"instances"`
+}
+
+// registry holds the latest snapshot of a deployment
+type registry struct {
+	mux      sync.RWMutex
+	snapshot *registrySnapshot
+}
+
+// instanceHealth maps the status of an instance to its health in the registry
+func instanceHealth(s instanceStatus) string {
+	switch {
+	case s.Error != nil:
+		return instanceUnknown
+	case !s.Running:
+		return instanceStopped
+	case s.Unhealthy != nil:
+		return instanceUnhealthy
+	default:
+		return instanceHealthy
+	}
+}
+
+// snapshotDeployment checks the status of all instances of a deployment. Instances on nodes whose hostname doesn't
+// resolve are listed without an IP and with unknown health, so that one node going away doesn't hide the others.
+func snapshotDeployment(m *deploymentManifest) *registrySnapshot {
+	ips := map[string]string{}
+	resolveErrs := map[string]error{}
+	for _, n := range m.Nodes {
+		ips[n.Hostname], resolveErrs[n.Hostname] = resolveIP(n.Hostname)
+	}
+
+	statuses := getInstanceStatuses(m, 0)
+	sortStatuses(statuses)
+
+	snapshot := registrySnapshot{m.ID, m.Slice, m.version(), time.Now(), []registryInstance{}}
+	for _, s := range statuses {
+		i := s.Instance
+		instance := registryInstance{i.ID, i.Hostname, ips[i.Hostname], i.Port, i.Ports, i.NodeIndex, i.Role, instanceHealth(s), ""}
+		if err := resolveErrs[i.Hostname]; err != nil {
+			instance.Health = instanceUnknown
+			instance.Error = fmt.Sprintf("Could not resolve %s: %v", i.Hostname, err)
+		} else if s.Error != nil {
+			instance.Error = s.Error.Error()
+		} else if s.Unhealthy != nil {
+			instance.Error = s.Unhealthy.Error()
+		}
+		snapshot.Instances = append(snapshot.Instances, instance)
+	}
+
+	return &snapshot
+}
+
+// membership returns a key identifying the set of healthy instances of a snapshot
+func (s *registrySnapshot) membership() string {
+	members := []string{}
+	for _, i := range s.Instances {
+		if i.Health == instanceHealthy {
+			members = append(members, fmt.Sprintf("%d@%s", i.ID, i.Hostname))
+		}
+	}
+	sort.Strings(members)
+	return s.Deployment + " " + strings.Join(members, ",")
+}
+
+// pushPeerList writes the peer list of the healthy instances of a snapshot to the nodes with a healthy instance
+// that don't have the current list in pushed yet, and records the nodes it was delivered to in pushed
+func pushPeerList(m *deploymentManifest, conf *plcliYmlFile, snapshot *registrySnapshot, pushed map[string]string, options *util.Options) error {
+	membership := snapshot.membership()
+	healthy := map[int]bool{}
+	for _, i := range snapshot.Instances {
+		if i.Health == instanceHealthy {
+			healthy[i.ID] = true
+		}
+	}
+
+	members := *m
+	members.Instances = []deploymentInstance{}
+	targets := []pl.Node{}
+	targeted := map[string]bool{}
+	for _, i := range m.Instances {
+		if !healthy[i.ID] {
+			continue
+		}
+		members.Instances = append(members.Instances, i)
+		// a node running several instances is written to once
+		if pushed[i.Hostname] != membership && !targeted[i.Hostname] {
+			targeted[i.Hostname] = true
+			targets = append(targets, pl.Node{HostName: i.Hostname, NodeID: i.NodeID})
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	pushOptions := *options
+	pushOptions.Slice = m.Slice
+	pushOptions.AppPath = m.AppPath
+	pushOptions.SkipWriteHostsFile = true
+	err := transferPeerList(&members, conf, targets, &pushOptions)
+
+	failed := map[string]bool{}
+	if e, ok := err.(*peerListError); ok {
+		for _, hostname := range e.failed {
+			failed[hostname] = true
+		}
+	} else if err != nil {
+		return err
+	}
+	delivered := 0
+	for _, n := range targets {
+		if !failed[n.HostName] {
+			pushed[n.HostName] = membership
+			delivered++
+		}
+	}
+	log.Printf("Pushed peer list of deployment %s to %d/%d nodes", m.ID, delivered, len(targets))
+	return err
+}
+
+// ServeHTTP lists the instances of the served deployment as json, optionally only those with the health given in
+// the health query parameter
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mux.RLock()
+	snapshot := r.snapshot
+	r.mux.RUnlock()
+
+	if snapshot == nil {
+		http.Error(w, "registry not ready yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	if health := req.URL.Query().Get("health"); health != "" {
+		filtered := *snapshot
+		filtered.Instances = []registryInstance{}
+		for _, i := range snapshot.Instances {
+			if i.Health == health {
+				filtered.Instances = append(filtered.Instances, i)
+			}
+		}
+		snapshot = &filtered
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
+
+// RegistryServe periodically checks the instances of a deployment and serves them over http. Without a deployment
+// ID the latest deployment is served, so that new deployments are picked up. With options.PushPeers set, the peer
+// list of the healthy instances is pushed to the nodes with a healthy instance whenever the set of healthy instances
+// changes. The peer list is rendered as configured in the .plcli.yml of the deployment served, which is reloaded
+// whenever a new deployment is picked up.
+func RegistryServe(deploymentID string, options *util.Options) error {
+	if _, err := loadManifest(deploymentID); err != nil {
+		return err
+	}
+
+	r := &registry{}
+	go func() {
+		// the peer list last delivered to each node, by hostname
+		pushed := map[string]string{}
+		// the .plcli.yml of the deployment served and its ID
+		var conf *plcliYmlFile
+		confID := ""
+		for {
+			m, err := loadManifest(deploymentID)
+			if err == nil && options.PushPeers && m.ID != confID {
+				conf, confID = m.loadConf(), m.ID
+			}
+			if err == nil {
+				snapshot := snapshotDeployment(m)
+				r.mux.Lock()
+				r.snapshot = snapshot
+				r.mux.Unlock()
+				log.Printf("Updated registry of deployment %s, %d instances", m.ID, len(snapshot.Instances))
+
+				if options.PushPeers {
+					err = pushPeerList(m, conf, snapshot, pushed, options)
+				}
+			}
+			if err != nil {
+				log.Printf("Updating registry failed: %v", err)
+			}
+			time.Sleep(options.RegistryInterval)
+		}
+	}()
+
+	http.Handle("/instances", r)
+	log.Printf("Serving instances on %s/instances", options.Listen)
+	return http.ListenAndServe(options.Listen, nil)
+}
@@ -0,0 +1,157 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// failDeployment handles a failed deployment. Its nodes are rolled back if options.RollbackOnFailure is set,
+// otherwise they are left as they are for plcli deploy --resume to continue from.
+func failDeployment(m *deploymentManifest, cause error, options *util.Options) error {
+	log.Printf("Deployment %s failed: %v", m.ID, cause)
+
+	if !options.RollbackOnFailure {
+		m.Status = deploymentFailed
+		if err := writeManifest(m); err != nil {
+			return err
+		}
+		return fmt.Errorf("Deployment %s failed: %v. Run plcli deploy --resume --deployment %s to continue it", m.ID, cause, m.ID)
+	}
+
+	err := rollbackDeployment(m, options)
+	if err != nil {
+		m.Status = deploymentFailed
+		writeManifest(m)
+		return fmt.Errorf("Deployment %s failed (%v) and so did its rollback: %v", m.ID, cause, err)
+	}
+
+	m.Status = deploymentRolledBack
+	m.FinishedAt = time.Now()
+	if err := writeManifest(m); err != nil {
+		return err
+	}
+	return fmt.Errorf("Deployment %s failed and was rolled back: %v", m.ID, cause)
+}
+
+// rollbackDeployment returns the nodes of a failed deployment to the state they were in before it. Nodes that were
+// part of the previous deployment on the slice get its commit and instances back, all other nodes are cleaned up.
+func rollbackDeployment(m *deploymentManifest, options *util.Options) error {
+	previous := &deploymentManifest{}
+	if m.PreviousID != "" {
+		var err error
+		previous, err = loadManifest(m.PreviousID)
+		if err != nil {
+			return err
+		}
+	}
+
+	inPrevious := map[string]bool{}
+	for _, n := range previous.Nodes {
+		inPrevious[n.Hostname] = true
+	}
+
+	failed := []string{}
+	restore := []pl.Node{}
+	for _, n := range m.touchedNodes() {
+		if inPrevious[n.HostName] {
+			restore = append(restore, n)
+			continue
+		}
+
+		log.Printf("Cleaning up node %s", n.HostName)
+		err := ExecCmdOnNode(m.Slice, n.HostName, fmt.Sprintf("kill -9 -1; cd && rm -rf %s", m.AppPath), false)
+		if err != nil {
+			log.Printf("Cleaning up node %s failed: %v", n.HostName, err)
+			failed = append(failed, n.HostName)
+		}
+	}
+
+	if len(restore) > 0 {
+		log.Printf("Rolling back %d nodes to deployment %s of %s", len(restore), previous.ID, previous.version())
+		conf := previous.loadConf()
+
+		previousOptions := *options
+		previousOptions.Slice = previous.Slice
+		previousOptions.AppPath = previous.AppPath
+		previousOptions.Sudo = previous.Sudo
+		if previous.Scale > 0 {
+			previousOptions.Scale = previous.Scale
+		}
+
+		bootstrapped := []pl.Node{}
+		for _, res := range bootstrapNodes(restore, previous, conf.BootstrapCmds, &previousOptions) {
+			if res.Error != nil {
+				failed = append(failed, res.Node.HostName)
+			} else {
+				bootstrapped = append(bootstrapped, res.Node)
+			}
+		}
+
+		if len(bootstrapped) > 0 {
+			if err := transferPeerList(previous, conf, bootstrapped, &previousOptions); err != nil {
+				return err
+			}
+			if err := renderTemplates(previous, conf, bootstrapped); err != nil {
+				return err
+			}
+		}
+
+		instances := []deploymentInstance{}
+		byHostname := previous.instancesByHostname()
+		for _, n := range bootstrapped {
+			instances = append(instances, byHostname[n.HostName]...)
+		}
+		for _, res := range launchNodes(previous, instances, conf, &previousOptions) {
+			if res.Error != nil {
+				failed = append(failed, res.Node.HostName)
+			}
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("Could not roll back nodes %v", failed)
+	}
+	log.Printf("Rolled back all %d nodes touched by deployment %s", len(m.touchedNodes()), m.ID)
+	return nil
+}
+
+// resumeDeploy continues a failed deployment from where it stopped, using the commit, env and nodes recorded in
+// its manifest
+func resumeDeploy(options *util.Options) error {
+	start := time.Now()
+	m, err := loadManifest(options.Deployment)
+	if err != nil {
+		return err
+	}
+
+	switch m.Status {
+	case deploymentComplete:
+		log.Printf("Deployment %s is already complete, nothing to resume", m.ID)
+		return nil
+	case deploymentRolledBack:
+		return fmt.Errorf("Deployment %s was rolled back, start a new deployment instead", m.ID)
+	}
+
+	log.Printf("Resuming deployment %s of %s, %d/%d nodes launched", m.ID, m.version(), len(m.nodesInState(nodeLaunched)), len(m.Nodes))
+	conf := m.loadConf()
+	options.Slice = m.Slice
+	options.AppPath = m.AppPath
+	options.Sudo = m.Sudo
+	options.Scale = m.Scale
+
+	m.Status = deploymentInProgress
+	err = writeManifest(m)
+	if err != nil {
+		return err
+	}
+
+	err = runDeployment(m, conf, options)
+	if err != nil {
+		return failDeployment(m, err, options)
+	}
+	return finishDeployment(m, conf, start, options)
+}
@@ -0,0 +1,282 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// default timeout and interval of readiness probes that don't set them
+const (
+	defaultProbeTimeout  = time.Minute
+	defaultProbeInterval = time.Second * 2
+)
+
+// probeCmd builds the command running a probe for an instance, with the env vars identifying the instance exported
+func probeCmd(appPath string, i deploymentInstance, p *probe) string {
+	cmd := fmt.Sprintf("cd %s", appPath)
+	for k, v := range instanceEnv(i) {
+		cmd += fmt.Sprintf(" && export %s=%s", k, util.ShellQuote(v))
+	}
+	return fmt.Sprintf("%s && %s", cmd, p.Cmd)
+}
+
+// waitForReady runs the readiness probe of an instance until it succeeds or its timeout passes
+func waitForReady(sliceName string, appPath string, i deploymentInstance, p *probe) error {
+	if p == nil || p.Cmd == "" {
+		return nil
+	}
+
+	timeout, interval := p.Timeout, p.Interval
+	if timeout == 0 {
+		timeout = defaultProbeTimeout
+	}
+	if interval == 0 {
+		interval = defaultProbeInterval
+	}
+
+	cmd := probeCmd(appPath, i, p)
+	deadline := time.Now().Add(timeout)
+	for {
+		_, err := ExecCmdOnNodeWithOutput(sliceName, i.Hostname, cmd)
+		if err == nil {
+			log.Printf("Instance %d on node %s is ready", i.ID, i.Hostname)
+			return nil
+		}
+		if time.Now().Add(interval).After(deadline) {
+			return fmt.Errorf("Instance %d on node %s not ready after %s: %v", i.ID, i.Hostname, timeout, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// updateNode stops the instances on a node, checks out commit, runs the bootstrap commands and launches the
+// instances again once they are ready. Unlike bootstrap, nothing else running on the node is touched.
+func updateNode(m *deploymentManifest, hostname string, commit string, conf *plcliYmlFile, env map[string]string, grace time.Duration, options *util.Options) error {
+	instances := m.instancesByHostname()[hostname]
+	for _, i := range instances {
+		if err := stopInstance(m, i, grace); err != nil {
+			return err
+		}
+	}
+
+	cmd := fmt.Sprintf("cd %s && git fetch origin && git checkout -f %s", m.AppPath, commit)
+	// the binary has to be in place before the bootstrap commands run
+	if m.Binary != nil {
+		if err := ExecCmdOnNode(m.Slice, hostname, cmd, false); err != nil {
+			return err
+		}
+		if err := uploadBinary(m.Slice, hostname, m.Binary, m.AppPath); err != nil {
+			return err
+		}
+		cmd = fmt.Sprintf("cd %s", m.AppPath)
+	}
+	for _, c := range conf.BootstrapCmds {
+		cmd += fmt.Sprintf(" && %s", c)
+	}
+	if err := ExecCmdOnNode(m.Slice, hostname, cmd, false); err != nil {
+		return err
+	}
+
+	node := pl.Node{HostName: hostname}
+	if err := renderTemplates(m, conf, []pl.Node{node}); err != nil {
+		return err
+	}
+	for _, i := range instances {
+		if err := launch(node, conf.launchScript(i, len(m.Instances), env), i.ID, m.Supervisor, options); err != nil {
+			return err
+		}
+	}
+	for _, i := range instances {
+		if err := waitForReady(m.Slice, m.AppPath, i, conf.ReadinessProbe); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Node %s updated to commit %.8s", hostname, commit)
+	return nil
+}
+
+// updateNodes updates the given nodes to commit concurrently and returns the errors of the nodes that failed, by
+// hostname
+func updateNodes(m *deploymentManifest, hostnames []string, commit string, conf *plcliYmlFile, env map[string]string, grace time.Duration, options *util.Options) map[string]error {
+	failed := map[string]error{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for _, hostname := range hostnames {
+		wg.Add(1)
+		go func(hostname string) {
+			defer wg.Done()
+			if err := updateNode(m, hostname, commit, conf, env, grace, options); err != nil {
+				log.Printf("Updating node %s failed: %v", hostname, err)
+				mux.Lock()
+				failed[hostname] = err
+				mux.Unlock()
+			}
+		}(hostname)
+	}
+	wg.Wait()
+
+	return failed
+}
+
+// failedHostnames returns the hostnames of the nodes that failed to update
+func failedHostnames(failed map[string]error) []string {
+	hostnames := []string{}
+	for hostname := range failed {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// rollingDeploy updates the nodes of an existing deployment, the latest completed one on the slice unless
+// options.Deployment is set, to the latest commit of options.GitBranch, a batch of nodes at a time. The update is
+// recorded as a new deployment whose nodes are pending until their batch ran the new commit, written after every
+// batch. The update halts as soon as a batch fails, after optionally rolling back all updated nodes to the previously
+// deployed commit.
+func rollingDeploy(gitURL string, options *util.Options) error {
+	start := time.Now()
+	previous := latestDeployment(options.Slice)
+	var err error
+	if options.Deployment != "" {
+		previous, err = loadManifest(options.Deployment)
+		if err != nil {
+			return err
+		}
+	} else if previous == nil {
+		return fmt.Errorf("No completed deployment on slice %s to update", options.Slice)
+	}
+	if previous.GitURL != gitURL {
+		return fmt.Errorf("Deployment %s is of %s, not %s", previous.ID, previous.GitURL, gitURL)
+	}
+
+	conf, commit := parseYML(gitURL, options.GitBranch)
+	if commit == previous.Commit {
+		log.Printf("Deployment %s is already at commit %.8s, nothing to do", previous.ID, commit)
+		return nil
+	}
+	for _, n := range previous.Nodes {
+		if conf.getRole(n.Role) == nil && (n.Role != "" || len(conf.LaunchCmds) == 0) {
+			return fmt.Errorf("Node %s has role %q, which commit %.8s no longer defines launch_cmds for", n.Hostname, n.Role, commit)
+		}
+	}
+
+	// the updated deployment keeps nodes, instances, paths and supervisor of the previous one
+	manifest := *previous
+	manifest.ID = newDeploymentID()
+	manifest.Branch = options.GitBranch
+	manifest.Commit = commit
+	manifest.Env = deploymentEnv(conf.Env, options)
+	manifest.LivenessProbe = conf.LivenessProbe
+	manifest.Artifacts = conf.Artifacts
+	manifest.PeerList = conf.Peers.dest()
+	manifest.Binary, err = buildApp(&manifest, conf.Build)
+	if err != nil {
+		return err
+	}
+	manifest.PreviousID = previous.ID
+	manifest.StartedAt = start
+	manifest.FinishedAt = time.Time{}
+	manifest.Status = deploymentInProgress
+	manifest.Nodes = append([]deploymentNode{}, previous.Nodes...)
+	for _, n := range manifest.Nodes {
+		manifest.setNodeState(n.Hostname, nodePending, nil)
+	}
+	options.AppPath = previous.AppPath
+	options.Sudo = previous.Sudo
+
+	err = runHooks("pre_deploy", conf.Hooks.PreDeploy, &manifest)
+	if err != nil {
+		return err
+	}
+	err = writeManifest(&manifest)
+	if err != nil {
+		return err
+	}
+	log.Printf("Deployment %s of %s recorded, run plcli status %s to inspect it", manifest.ID, manifest.version(), manifest.ID)
+
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	log.Printf("Rolling deployment of commit %.8s to %d nodes of deployment %s, %d nodes at a time", commit, len(previous.Nodes), previous.ID, batchSize)
+
+	updated := []string{}
+	for b := 0; b < len(previous.Nodes); b += batchSize {
+		end := b + batchSize
+		if end > len(previous.Nodes) {
+			end = len(previous.Nodes)
+		}
+		batch := []string{}
+		for _, n := range previous.Nodes[b:end] {
+			batch = append(batch, n.Hostname)
+		}
+
+		log.Printf("Updating nodes %v", batch)
+		updated = append(updated, batch...)
+		failed := updateNodes(&manifest, batch, commit, conf, manifest.Env, options.GracePeriod, options)
+		for _, hostname := range batch {
+			if err := failed[hostname]; err != nil {
+				manifest.setNodeState(hostname, nodePending, err)
+			} else {
+				manifest.setNodeState(hostname, nodeLaunched, nil)
+			}
+		}
+		if len(failed) == 0 {
+			if err := writeManifest(&manifest); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !options.RollbackOnFailure {
+			manifest.Status = deploymentFailed
+			if err := writeManifest(&manifest); err != nil {
+				return err
+			}
+			return fmt.Errorf("Rolling deployment halted, nodes %v failed to update. Nodes %v run commit %.8s, the rest still run %.8s",
+				failedHostnames(failed), updated, commit, previous.Commit)
+		}
+
+		log.Printf("Nodes %v failed to update, rolling back %d nodes to commit %.8s", failedHostnames(failed), len(updated), previous.Commit)
+		previousConf, _ := parseYML(previous.GitURL, previous.Commit)
+		failedRollback := updateNodes(previous, updated, previous.Commit, previousConf, previous.Env, options.GracePeriod, options)
+		if len(failedRollback) > 0 {
+			manifest.Status = deploymentFailed
+			writeManifest(&manifest)
+			return fmt.Errorf("Rolling deployment failed and rollback of nodes %v failed as well", failedHostnames(failedRollback))
+		}
+		for _, hostname := range updated {
+			manifest.setNodeState(hostname, nodePending, failed[hostname])
+		}
+		manifest.Status = deploymentRolledBack
+		manifest.FinishedAt = time.Now()
+		if err := writeManifest(&manifest); err != nil {
+			return err
+		}
+		return fmt.Errorf("Rolling deployment failed on nodes %v, all nodes were rolled back to commit %.8s", failedHostnames(failed), previous.Commit)
+	}
+
+	manifest.Status = deploymentComplete
+	manifest.FinishedAt = time.Now()
+	err = writeManifest(&manifest)
+	if err != nil {
+		return err
+	}
+
+	if options.PrometheusSDPath != "" {
+		if err := writeServiceDiscovery(&manifest, conf, options); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Rolling deployment %s finished in %s", manifest.ID, time.Since(start))
+	return runHooks("post_deploy", conf.Hooks.PostDeploy, &manifest)
+}
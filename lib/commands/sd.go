@@ -0,0 +1,265 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// formats the service discovery file can be written in
+const (
+	sdPrometheus   = "prometheus"
+	sdConsul       = "consul"
+	sdGrafanaAgent = "grafana-agent"
+)
+
+// labels plcli can attach to every target, and those it attaches unless .plcli.yml picks others
+var (
+	sdBuiltinLabels = map[string]bool{"site": true, "hostname": true, "role": true, "instance_id": true, "deployment_id": true, "commit": true}
+	sdDefaultLabels = []string{"site", "instance_id", "deployment_id", "commit"}
+)
+
+// serviceDiscovery configures the service discovery file written with --prometheus-sd-path. Every job lists the
+// instances of the deployment on a port, or every node on node_port.
+type serviceDiscovery struct {
+	Format       string            `yaml:"format"`
+	Jobs         []sdJob           `yaml:"jobs"`
+	Labels       []string          `yaml:"labels"`
+	StaticLabels map[string]string `yaml:"static_labels"`
+}
+
+// sdJob is a group of targets. Port names one of the ports of .plcli.yml, the instance port is used if it is empty.
+type sdJob struct {
+	Name     string            `yaml:"name"`
+	Port     string            `yaml:"port"`
+	NodePort int               `yaml:"node_port"`
+	Labels   map[string]string `yaml:"labels"`
+}
+
+// sdTarget is an address to scrape along with its labels, including the job
+type sdTarget struct {
+	Job      string
+	ID       string
+	Hostname string
+	Port     int
+	Labels   map[string]string
+}
+
+// validate checks the service discovery config for errors
+func (s *serviceDiscovery) validate(ports map[string]int, add func(msg string, path ...interface{})) {
+	if s.Format != "" && s.Format != sdPrometheus && s.Format != sdConsul && s.Format != sdGrafanaAgent {
+		add(fmt.Sprintf("service discovery format %s is not one of prometheus, consul and grafana-agent", s.Format), "service_discovery", "format")
+	}
+
+	for i, l := range s.Labels {
+		if !sdBuiltinLabels[l] {
+			add(fmt.Sprintf("label %s is not one of site, hostname, role, instance_id, deployment_id and commit", l), "service_discovery", "labels", i)
+		}
+	}
+	for k := range s.StaticLabels {
+		if !envNamePattern.MatchString(k) {
+			add(fmt.Sprintf("%s is not a valid label name", k), "service_discovery", "static_labels", k)
+		}
+	}
+
+	names := map[string]bool{}
+	for i, j := range s.Jobs {
+		if j.Name == "" {
+			add("job has no name", "service_discovery", "jobs", i)
+		} else if names[j.Name] {
+			add(fmt.Sprintf("job %s is defined more than once", j.Name), "service_discovery", "jobs", i, "name")
+		}
+		names[j.Name] = true
+
+		if j.Port != "" && j.NodePort != 0 {
+			add("job can't have both port and node_port", "service_discovery", "jobs", i)
+		}
+		if _, ok := ports[j.Port]; j.Port != "" && !ok {
+			add(fmt.Sprintf("port %s is not defined in ports", j.Port), "service_discovery", "jobs", i, "port")
+		}
+		if j.NodePort < 0 || j.NodePort > 65535 {
+			add("node_port must be between 1 and 65535", "service_discovery", "jobs", i, "node_port")
+		}
+		for k := range j.Labels {
+			if !envNamePattern.MatchString(k) {
+				add(fmt.Sprintf("%s is not a valid label name", k), "service_discovery", "jobs", i, "labels", k)
+			}
+		}
+	}
+}
+
+// jobs returns the configured jobs, or a job named app for the instance ports if there are none. A job named after
+// every addon exposing metrics is added for the port of the addon on every node, unless a job of that name is
+// configured.
+func (s *serviceDiscovery) jobs(addons []addon) []sdJob {
+	jobs := s.Jobs
+	if len(jobs) == 0 {
+		jobs = []sdJob{{Name: "app"}}
+	}
+	names := map[string]bool{}
+	for _, j := range jobs {
+		names[j.Name] = true
+	}
+	for _, a := range addons {
+		if a.Metrics && !names[a.Name] {
+			jobs = append(jobs, sdJob{Name: a.Name, NodePort: a.Port})
+		}
+	}
+	return jobs
+}
+
+// siteNames looks up the login base of the site of every node of a deployment, by hostname
+func siteNames(m *deploymentManifest) (map[string]string, error) {
+	nodeIDs := []int{}
+	for _, n := range m.Nodes {
+		nodeIDs = append(nodeIDs, n.NodeID)
+	}
+	nodes, err := pl.FetchNodesDetails(nodeIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch nodes of deployment %s: %v", m.ID, err)
+	}
+
+	siteIDs := []int{}
+	for _, n := range nodes {
+		siteIDs = append(siteIDs, n.SiteID)
+	}
+	plSites, err := pl.FetchSites(siteIDs)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch sites of deployment %s: %v", m.ID, err)
+	}
+	sites := map[int]string{}
+	for _, s := range plSites {
+		sites[s.SiteID] = s.LoginBase
+	}
+
+	names := map[string]string{}
+	for _, n := range nodes {
+		names[n.HostName] = sites[n.SiteID]
+	}
+	return names, nil
+}
+
+// sdTargets lists the targets of every job for a deployment
+func sdTargets(m *deploymentManifest, s *serviceDiscovery) ([]sdTarget, error) {
+	labelNames := s.Labels
+	if labelNames == nil {
+		labelNames = sdDefaultLabels
+	}
+	enabled := map[string]bool{}
+	for _, l := range labelNames {
+		enabled[l] = true
+	}
+	sites := map[string]string{}
+	if enabled["site"] {
+		var err error
+		sites, err = siteNames(m)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	roles := map[string]string{}
+	for _, n := range m.Nodes {
+		roles[n.Hostname] = n.Role
+	}
+	labels := func(j sdJob, hostname string, instanceID string) map[string]string {
+		builtin := map[string]string{"site": sites[hostname], "hostname": hostname, "role": roles[hostname],
+			"instance_id": instanceID, "deployment_id": m.ID, "commit": m.Commit}
+		l := map[string]string{}
+		for k, v := range s.StaticLabels {
+			l[k] = v
+		}
+		for k := range enabled {
+			if builtin[k] != "" {
+				l[k] = builtin[k]
+			}
+		}
+		for k, v := range j.Labels {
+			l[k] = v
+		}
+		l["job"] = j.Name
+		return l
+	}
+
+	targets := []sdTarget{}
+	for _, j := range s.jobs(m.Addons) {
+		if j.NodePort != 0 {
+			for _, n := range m.Nodes {
+				targets = append(targets, sdTarget{j.Name, n.Hostname, n.Hostname, j.NodePort, labels(j, n.Hostname, "")})
+			}
+			continue
+		}
+		for _, i := range m.Instances {
+			port := i.Port
+			if j.Port != "" {
+				port = i.Ports[j.Port]
+			}
+			if port == 0 {
+				continue
+			}
+			id := strconv.Itoa(i.ID)
+			targets = append(targets, sdTarget{j.Name, id, i.Hostname, port, labels(j, i.Hostname, id)})
+		}
+	}
+	return targets, nil
+}
+
+// renderSD renders targets in a service discovery format. prometheus and grafana-agent are file_sd files, which is
+// what the discovery.file component of grafana agent reads, and consul a services file that can be registered with
+// consul services register.
+func renderSD(format string, targets []sdTarget, deploymentID string) ([]byte, error) {
+	switch format {
+	case sdConsul:
+		type consulService struct {
+			ID      string            `json:"id"`
+			Name    string            `json:"name"`
+			Address string            `json:"address"`
+			Port    int               `json:"port"`
+			Tags    []string          `json:"tags"`
+			Meta    map[string]string `json:"meta"`
+		}
+		services := []consulService{}
+		for _, t := range targets {
+			id := fmt.Sprintf("%s-%s-%s", t.Job, deploymentID, t.ID)
+			services = append(services, consulService{id, t.Job, t.Hostname, t.Port, []string{"plcli", deploymentID}, t.Labels})
+		}
+		return json.MarshalIndent(map[string][]consulService{"services": services}, "", "  ")
+	default:
+		type fileSDGroup struct {
+			Targets []string          `json:"targets"`
+			Labels  map[string]string `json:"labels"`
+		}
+		groups := []fileSDGroup{}
+		for _, t := range targets {
+			groups = append(groups, fileSDGroup{[]string{net.JoinHostPort(t.Hostname, strconv.Itoa(t.Port))}, t.Labels})
+		}
+		return json.MarshalIndent(groups, "", "  ")
+	}
+}
+
+// writeServiceDiscovery writes the service discovery file of a deployment to options.PrometheusSDPath, replacing
+// the previous one at once so that readers never see a partial file
+func writeServiceDiscovery(m *deploymentManifest, conf *plcliYmlFile, options *util.Options) error {
+	targets, err := sdTargets(m, &conf.ServiceDiscovery)
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(targets, func(i, j int) bool { return targets[i].Job < targets[j].Job })
+
+	data, err := renderSD(conf.ServiceDiscovery.Format, targets, m.ID)
+	if err != nil {
+		return err
+	}
+	if err := util.WriteFileAtomic(options.PrometheusSDPath, data, 0644); err != nil {
+		return fmt.Errorf("Could not write service discovery file: %v", err)
+	}
+
+	log.Printf("Wrote %d service discovery targets to %s", len(targets), options.PrometheusSDPath)
+	return nil
+}
@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var testSDTargets = []sdTarget{
+	{"app", "0", "a.example.org", 2112, map[string]string{"job": "app", "instance_id": "0"}},
+	{"node_exporter", "b.example.org", "b.example.org", 9100, map[string]string{"job": "node_exporter"}},
+}
+
+func TestRenderSDFileSD(t *testing.T) {
+	expected := []map[string]interface{}{
+		{"targets": []interface{}{"a.example.org:2112"}, "labels": map[string]interface{}{"job": "app", "instance_id": "0"}},
+		{"targets": []interface{}{"b.example.org:9100"}, "labels": map[string]interface{}{"job": "node_exporter"}},
+	}
+	// grafana agent reads the same file_sd files as prometheus
+	for _, format := range []string{"", sdPrometheus, sdGrafanaAgent} {
+		data, err := renderSD(format, testSDTargets, "20200101-000000-aaaa")
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := []map[string]interface{}{}
+		if err := json.Unmarshal(data, &groups); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(groups, expected) {
+			t.Errorf("Format %q rendered %s", format, data)
+		}
+	}
+}
+
+func TestRenderSDConsul(t *testing.T) {
+	data, err := renderSD(sdConsul, testSDTargets, "20200101-000000-aaaa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	services := map[string][]struct {
+		ID      string            `json:"id"`
+		Name    string            `json:"name"`
+		Address string            `json:"address"`
+		Port    int               `json:"port"`
+		Tags    []string          `json:"tags"`
+		Meta    map[string]string `json:"meta"`
+	}{}
+	if err := json.Unmarshal(data, &services); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(services["services"]) != 2 {
+		t.Fatalf("Rendered %s, expected 2 services", data)
+	}
+	s := services["services"][0]
+	if s.ID != "app-20200101-000000-aaaa-0" || s.Name != "app" || s.Address != "a.example.org" || s.Port != 2112 {
+		t.Errorf("Rendered service %+v", s)
+	}
+	if !reflect.DeepEqual(s.Tags, []string{"plcli", "20200101-000000-aaaa"}) || s.Meta["instance_id"] != "0" {
+		t.Errorf("Rendered tags %v and meta %v", s.Tags, s.Meta)
+	}
+	if id := services["services"][1].ID; id != "node_exporter-20200101-000000-aaaa-b.example.org" {
+		t.Errorf("Rendered node service with ID %s", id)
+	}
+}
+
+func TestSDTargets(t *testing.T) {
+	m := &deploymentManifest{
+		ID:     "20200101-000000-aaaa",
+		Commit: "abcdef",
+		Nodes:  []deploymentNode{{Hostname: "a.example.org", Role: "server"}},
+		Instances: []deploymentInstance{
+			{ID: 0, Hostname: "a.example.org", Port: 2112, Ports: map[string]int{"metrics": 9000}},
+			{ID: 1, Hostname: "a.example.org", Port: 2113},
+		},
+	}
+	s := &serviceDiscovery{
+		Labels:       []string{"role", "instance_id"},
+		StaticLabels: map[string]string{"env": "test"},
+		Jobs:         []sdJob{{Name: "metrics", Port: "metrics"}, {Name: "node", NodePort: 9100, Labels: map[string]string{"env": "node"}}},
+	}
+
+	targets, err := sdTargets(m, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// instances without the port of a job are left out of it, job labels override static ones
+	expected := []sdTarget{
+		{"metrics", "0", "a.example.org", 9000, map[string]string{"job": "metrics", "env": "test", "role": "server", "instance_id": "0"}},
+		{"node", "a.example.org", "a.example.org", 9100, map[string]string{"job": "node", "env": "node", "role": "server"}},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("Listed targets %+v, expected %+v", targets, expected)
+	}
+}
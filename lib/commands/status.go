@@ -0,0 +1,174 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/supervisor"
+)
+
+// instanceStatus is the state of an app instance on a node
+type instanceStatus struct {
+	Instance deploymentInstance
+	Running  bool
+	Uptime   time.Duration
+	LogLines []string
+	Error    error
+	// set if the instance is running but its liveness probe fails
+	Unhealthy error
+	// set if the instance runs under plcli-supervisor
+	Supervisor *supervisor.Status
+}
+
+// statusCmd builds a command that prints "running SECONDS" or "stopped" for an instance, followed by the last
+// lines of its log. The pid file written on launch is used to find the instance, with a fallback to
+// looking for its start script.
+func statusCmd(instanceID int, lines int) string {
+	return fmt.Sprintf("pid=$(cat ~/logs/instance_%d.pid 2>/dev/null || pgrep -o -f start_instance_%d.sh); "+
+		"etimes=$(ps -o etimes= -p \"$pid\" 2>/dev/null | tr -d ' '); "+
+		"if [ -n \"$pid\" ] && [ -n \"$etimes\" ]; then echo \"running $etimes\"; else echo stopped; fi; "+
+		"tail -n %d ~/logs/instance_%d.log 2>/dev/null; true", instanceID, instanceID, lines, instanceID)
+}
+
+// parseStatus parses the output of statusCmd
+func parseStatus(instance deploymentInstance, out string) instanceStatus {
+	status := instanceStatus{Instance: instance}
+	lines := strings.Split(strings.TrimRight(out, "\n"), "\n")
+
+	fields := strings.Fields(lines[0])
+	if len(fields) == 2 && fields[0] == "running" {
+		status.Running = true
+		seconds, _ := strconv.Atoi(fields[1])
+		status.Uptime = time.Duration(seconds) * time.Second
+	}
+	if len(lines) > 1 {
+		status.LogLines = lines[1:]
+	}
+
+	return status
+}
+
+// getInstanceStatuses connects to all nodes of a deployment concurrently and returns the status of every instance
+func getInstanceStatuses(m *deploymentManifest, lines int) []instanceStatus {
+	statuses := []instanceStatus{}
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+
+	for hostname, instances := range m.instancesByHostname() {
+		wg.Add(1)
+		go func(hostname string, instances []deploymentInstance) {
+			defer wg.Done()
+			for _, i := range instances {
+				var status instanceStatus
+				if m.Supervisor != nil {
+					status = supervisedStatus(m, i, lines)
+				} else {
+					out, err := ExecCmdOnNodeWithOutput(m.Slice, hostname, statusCmd(i.ID, lines))
+					status = parseStatus(i, out)
+					if err != nil {
+						status = instanceStatus{Instance: i, Error: err}
+					}
+				}
+				if status.Error == nil && status.Running && m.LivenessProbe != nil {
+					_, status.Unhealthy = ExecCmdOnNodeWithOutput(m.Slice, hostname, probeCmd(m.AppPath, i, m.LivenessProbe))
+				}
+
+				mux.Lock()
+				statuses = append(statuses, status)
+				mux.Unlock()
+			}
+		}(hostname, instances)
+	}
+	wg.Wait()
+
+	return statuses
+}
+
+// sortStatuses orders statuses by instance ID and hostname
+func sortStatuses(statuses []instanceStatus) {
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Instance.ID != statuses[j].Instance.ID {
+			return statuses[i].Instance.ID < statuses[j].Instance.ID
+		}
+		return statuses[i].Instance.Hostname < statuses[j].Instance.Hostname
+	})
+}
+
+// ListDeployments prints all recorded deployments
+func ListDeployments() error {
+	ids, err := listDeploymentIDs()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "ID\tSLICE\tSOURCE\tBRANCH\tVERSION\tSTATUS\tNODES\tINSTANCES")
+	for _, id := range ids {
+		m, err := loadManifest(id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", m.ID, m.Slice, m.origin(), m.Branch, m.version(), m.Status, len(m.Nodes), len(m.Instances))
+	}
+
+	return nil
+}
+
+// Status connects to every node of a deployment and reports whether each app instance is still running
+func Status(deploymentID string, lines int) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Fetching status of %d instances on %d nodes", len(m.Instances), len(m.Nodes))
+	statuses := getInstanceStatuses(m, lines)
+
+	fmt.Printf("\nDeployment %s of %s (branch %s, %s) on slice %s, started %s\n\n", m.ID, m.origin(), m.Branch,
+		m.version(), m.Slice, m.StartedAt.Format(time.RFC3339))
+
+	sortStatuses(statuses)
+	running := 0
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tHOSTNAME\tPORT\tSTATUS\tUPTIME")
+	for _, s := range statuses {
+		state := "stopped"
+		if s.Error != nil {
+			state = fmt.Sprintf("unknown (%v)", s.Error)
+		} else if s.Running && s.Unhealthy != nil {
+			state = "running, liveness probe failing"
+			running++
+		} else if s.Running {
+			state = "running"
+			running++
+		} else if s.Supervisor != nil && s.Supervisor.State != supervisor.StateStopped {
+			state = fmt.Sprintf("%s (%s)", s.Supervisor.State, s.Supervisor.LastExit)
+		}
+		if s.Supervisor != nil && s.Supervisor.Restarts > 0 {
+			state += fmt.Sprintf(", %d restarts", s.Supervisor.Restarts)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", s.Instance.ID, s.Instance.Hostname, s.Instance.Port, state, s.Uptime)
+	}
+	w.Flush()
+
+	for _, s := range statuses {
+		if len(s.LogLines) == 0 {
+			continue
+		}
+		fmt.Printf("\n### Instance %d on %s ###\n", s.Instance.ID, s.Instance.Hostname)
+		for _, l := range s.LogLines {
+			fmt.Println(l)
+		}
+	}
+
+	fmt.Printf("\n%d/%d instances running\n", running, len(statuses))
+	return nil
+}
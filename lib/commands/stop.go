@@ -0,0 +1,163 @@
+package commands
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selectInstances returns the instances of a deployment with the given comma separated IDs, or all instances if
+// ids is empty
+func selectInstances(m *deploymentManifest, ids string) ([]deploymentInstance, error) {
+	if ids == "" {
+		return m.Instances, nil
+	}
+
+	selected := []deploymentInstance{}
+	for _, idString := range strings.Split(ids, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(idString))
+		if err != nil {
+			return nil, fmt.Errorf("Malformed instance ID %s", idString)
+		}
+
+		found := false
+		for _, i := range m.Instances {
+			if i.ID == id {
+				selected = append(selected, i)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Deployment %s has no instance with ID %d", m.ID, id)
+		}
+	}
+
+	return selected, nil
+}
+
+// onInstances runs f for every instance, concurrently across nodes but one instance at a time per node, and
+// returns the number of instances for which f failed
+func onInstances(instances []deploymentInstance, f func(i deploymentInstance) error) int {
+	byHostname := map[string][]deploymentInstance{}
+	for _, i := range instances {
+		byHostname[i.Hostname] = append(byHostname[i.Hostname], i)
+	}
+
+	failures := 0
+	mux := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	for _, nodeInstances := range byHostname {
+		wg.Add(1)
+		go func(nodeInstances []deploymentInstance) {
+			defer wg.Done()
+			for _, i := range nodeInstances {
+				if err := f(i); err != nil {
+					log.Printf("Instance %d on node %s failed: %v", i.ID, i.Hostname, err)
+					mux.Lock()
+					failures++
+					mux.Unlock()
+				}
+			}
+		}(nodeInstances)
+	}
+	wg.Wait()
+
+	return failures
+}
+
+// stopInstanceCmd builds a command that sends SIGTERM to the process group of an instance, waits up to grace
+// for it to exit and then sends SIGKILL. The pid file holds the pid of the start script, which leads the process
+// group of the instance.
+func stopInstanceCmd(instanceID int, grace time.Duration, sudo bool) string {
+	prefix := ""
+	if sudo {
+		prefix = "sudo "
+	}
+
+	signal := func(sig string) string {
+		return fmt.Sprintf("%skill -s %s -- -$pgid 2>/dev/null", prefix, sig)
+	}
+	alive := signal("0")
+
+	cmds := []string{
+		fmt.Sprintf("pidfile=~/logs/instance_%d.pid", instanceID),
+		"pgid=$(cat $pidfile 2>/dev/null)",
+		fmt.Sprintf("if [ -z \"$pgid\" ] || ! %s; then echo \"not running\"; %srm -f $pidfile; exit 0; fi", alive, prefix),
+		signal("TERM"),
+		fmt.Sprintf("i=0; while [ $i -lt %d ] && %s; do sleep 1; i=$((i+1)); done", int(grace.Seconds()), alive),
+		fmt.Sprintf("if %s; then %s; echo killed; else echo stopped; fi", alive, signal("KILL")),
+		fmt.Sprintf("%srm -f $pidfile", prefix),
+	}
+	return strings.Join(cmds, "; ")
+}
+
+// stopInstance stops a single instance of a deployment
+func stopInstance(m *deploymentManifest, i deploymentInstance, grace time.Duration) error {
+	if m.Supervisor != nil {
+		return stopSupervised(m, i, grace)
+	}
+
+	out, err := ExecCmdOnNodeWithOutput(m.Slice, i.Hostname, stopInstanceCmd(i.ID, grace, m.Sudo))
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Instance %d on node %s: %s", i.ID, i.Hostname, strings.TrimSpace(out))
+	return nil
+}
+
+// Stop stops the given instances of a deployment, or all of them if instanceIDs is empty. Instances get
+// SIGTERM and are killed with SIGKILL if they are still running after grace.
+func Stop(deploymentID string, instanceIDs string, grace time.Duration) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	instances, err := selectInstances(m, instanceIDs)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Stopping %d instances of deployment %s", len(instances), m.ID)
+	failures := onInstances(instances, func(i deploymentInstance) error {
+		return stopInstance(m, i, grace)
+	})
+	if failures > 0 {
+		return fmt.Errorf("Failed to stop %d/%d instances", failures, len(instances))
+	}
+
+	log.Printf("Stopped %d instances", len(instances))
+	return nil
+}
+
+// Restart stops the given instances of a deployment, or all of them if instanceIDs is empty, and starts them again
+// using the start scripts written when they were launched, which keeps their instance IDs and env
+func Restart(deploymentID string, instanceIDs string, grace time.Duration) error {
+	m, err := loadManifest(deploymentID)
+	if err != nil {
+		return err
+	}
+
+	instances, err := selectInstances(m, instanceIDs)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Restarting %d instances of deployment %s", len(instances), m.ID)
+	failures := onInstances(instances, func(i deploymentInstance) error {
+		if err := stopInstance(m, i, grace); err != nil {
+			return err
+		}
+		return ExecCmdOnNode(m.Slice, i.Hostname, startInstanceCmd(m.AppPath, i.ID, m.Sudo, m.Supervisor), false)
+	})
+	if failures > 0 {
+		return fmt.Errorf("Failed to restart %d/%d instances", failures, len(instances))
+	}
+
+	log.Printf("Restarted %d instances", len(instances))
+	return nil
+}
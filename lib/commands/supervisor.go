@@ -0,0 +1,212 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib"
+	"github.com/axelniklasson/plcli/lib/supervisor"
+)
+
+// where the supervisor binary is placed on nodes, relative to the home dir
+const supervisorRemotePath = ".plcli/plcli-supervisor"
+
+// supervisorConfig makes instances run under plcli-supervisor, which restarts them according to the restart
+// policy, with a backoff doubling from backoff up to max_backoff, and rotates their logs
+type supervisorConfig struct {
+	Restart      string        `yaml:"restart" json:"restart"`
+	Backoff      time.Duration `yaml:"backoff" json:"backoff,omitempty"`
+	MaxBackoff   time.Duration `yaml:"max_backoff" json:"max_backoff,omitempty"`
+	MaxLogSizeMB int           `yaml:"max_log_size_mb" json:"max_log_size_mb,omitempty"`
+	MaxLogFiles  int           `yaml:"max_log_files" json:"max_log_files,omitempty"`
+}
+
+// GOARCH and GOARM of the supervisor built for each node arch
+var supervisorTargets = map[string][2]string{
+	"amd64": {"amd64", ""},
+	"386":   {"386", ""},
+	"arm64": {"arm64", ""},
+	"armv7": {"arm", "7"},
+	"armv6": {"arm", "6"},
+}
+
+// supervisor binaries built in this run of plcli, by node arch
+var (
+	supervisorBinaries    = map[string]string{}
+	supervisorBinariesMux sync.Mutex
+)
+
+// validate checks the supervisor section of a .plcli.yml for errors
+func (s *supervisorConfig) validate(add func(msg string, path ...interface{})) {
+	if s == nil {
+		return
+	}
+	if s.Restart != "" && s.Restart != supervisor.RestartNever && s.Restart != supervisor.RestartOnFailure && s.Restart != supervisor.RestartAlways {
+		add(fmt.Sprintf("restart policy %s is not one of never, on-failure and always", s.Restart), "supervisor", "restart")
+	}
+	if s.Backoff < 0 || s.MaxBackoff < 0 {
+		add("backoff and max_backoff can't be negative", "supervisor")
+	}
+	if s.MaxLogSizeMB < 0 || s.MaxLogFiles < 0 {
+		add("max_log_size_mb and max_log_files can't be negative", "supervisor")
+	}
+}
+
+// runArgs returns the flags of plcli-supervisor run for the config
+func (s *supervisorConfig) runArgs() string {
+	restart := s.Restart
+	if restart == "" {
+		restart = supervisor.RestartOnFailure
+	}
+	args := fmt.Sprintf("-restart %s", restart)
+	if s.Backoff > 0 {
+		args += fmt.Sprintf(" -backoff %s", s.Backoff)
+	}
+	if s.MaxBackoff > 0 {
+		args += fmt.Sprintf(" -max-backoff %s", s.MaxBackoff)
+	}
+	if s.MaxLogSizeMB > 0 {
+		args += fmt.Sprintf(" -max-log-size %d", s.MaxLogSizeMB*1024*1024)
+	}
+	if s.MaxLogFiles > 0 {
+		args += fmt.Sprintf(" -max-log-files %d", s.MaxLogFiles)
+	}
+	return args
+}
+
+// supervisorSocket returns the path of the control socket of the supervisor of an instance
+func supervisorSocket(instanceID int) string {
+	return fmt.Sprintf("~/logs/instance_%d.sock", instanceID)
+}
+
+// supervisedStartCmd builds the command that starts the supervisor of an instance in the background, which runs
+// the start script of the instance
+func supervisedStartCmd(appPath string, instanceID int, prefix string, s *supervisorConfig) string {
+	return fmt.Sprintf("cd %s; %ssetsid nohup ~/%s run %s -socket %s -log ~/logs/instance_%d.log -- sh start_instance_%d.sh ~/logs/instance_%d.pid "+
+		"> ~/logs/instance_%d.supervisor.log 2>&1 < /dev/null &",
+		appPath, prefix, supervisorRemotePath, s.runArgs(), supervisorSocket(instanceID), instanceID, instanceID, instanceID, instanceID)
+}
+
+// supervisorDown returns whether an error of supervisorCtl means that there is no supervisor listening
+func supervisorDown(err error) bool {
+	return strings.Contains(err.Error(), "dial unix")
+}
+
+// supervisorCtl sends a command to the supervisor of an instance over ssh and returns its response
+func supervisorCtl(m *deploymentManifest, i deploymentInstance, cmd string, flags string) (*supervisor.Response, error) {
+	prefix := ""
+	if m.Sudo {
+		prefix = "sudo "
+	}
+	out, err := ExecCmdOnNodeWithOutput(m.Slice, i.Hostname, fmt.Sprintf("%s~/%s ctl -socket %s %s %s", prefix, supervisorRemotePath, supervisorSocket(i.ID), flags, cmd))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(out))
+	}
+
+	resp := supervisor.Response{}
+	if err := json.Unmarshal([]byte(out), &resp); err != nil {
+		return nil, fmt.Errorf("Malformed response of supervisor of instance %d: %v", i.ID, err)
+	}
+	return &resp, nil
+}
+
+// buildSupervisor builds plcli-supervisor from the plcli source for nodes of arch, once per run of plcli
+func buildSupervisor(arch string) (string, error) {
+	supervisorBinariesMux.Lock()
+	defer supervisorBinariesMux.Unlock()
+
+	if path, ok := supervisorBinaries[arch]; ok {
+		return path, nil
+	}
+	target, ok := supervisorTargets[arch]
+	if !ok {
+		return "", fmt.Errorf("plcli-supervisor can't be built for %s", arch)
+	}
+
+	dir, err := ioutil.TempDir("", "plcli-supervisor")
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "plcli-supervisor")
+
+	cmd := exec.Command("go", "build", "-o", path, "./cmd/plcli-supervisor")
+	cmd.Dir = filepath.Dir(lib.BasePath)
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux", fmt.Sprintf("GOARCH=%s", target[0]), fmt.Sprintf("GOARM=%s", target[1]))
+	log.Printf("Building plcli-supervisor for %s", arch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("Building plcli-supervisor failed: %v\n%s", err, out)
+	}
+	if err := verifyBinary(path, target[0]); err != nil {
+		return "", err
+	}
+
+	supervisorBinaries[arch] = path
+	return path, nil
+}
+
+// uploadSupervisor builds plcli-supervisor for the arch of a node and places it at supervisorRemotePath
+func uploadSupervisor(sliceName string, hostname string) error {
+	arch, err := nodeArch(sliceName, hostname)
+	if err != nil {
+		return err
+	}
+	path, err := buildSupervisor(arch)
+	if err != nil {
+		return err
+	}
+
+	if err := ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("mkdir -p %s", filepath.Dir(supervisorRemotePath)), false); err != nil {
+		return err
+	}
+	if err := Transfer(sliceName, hostname, path, supervisorRemotePath+".tmp"); err != nil {
+		return err
+	}
+	return ExecCmdOnNode(sliceName, hostname, fmt.Sprintf("chmod +x %s.tmp && mv -f %s.tmp %s", supervisorRemotePath, supervisorRemotePath, supervisorRemotePath), false)
+}
+
+// supervisedStatus gets the status of an instance from its supervisor, an instance without a reachable supervisor
+// is stopped
+func supervisedStatus(m *deploymentManifest, i deploymentInstance, lines int) instanceStatus {
+	status := instanceStatus{Instance: i}
+	resp, err := supervisorCtl(m, i, "status", "")
+	if err != nil && !supervisorDown(err) {
+		status.Error = err
+		return status
+	}
+	if err == nil && resp.Status != nil {
+		status.Running = resp.Status.State == supervisor.StateRunning
+		status.Uptime = time.Duration(resp.Status.UptimeSeconds) * time.Second
+		status.Supervisor = resp.Status
+	}
+	if lines > 0 {
+		out, err := ExecCmdOnNodeWithOutput(m.Slice, i.Hostname, fmt.Sprintf("tail -n %d ~/logs/instance_%d.log 2>/dev/null; true", lines, i.ID))
+		if err != nil {
+			status.Error = err
+		} else if out = strings.TrimRight(out, "\n"); out != "" {
+			status.LogLines = strings.Split(out, "\n")
+		}
+	}
+	return status
+}
+
+// stopSupervised stops an instance and its supervisor
+func stopSupervised(m *deploymentManifest, i deploymentInstance, grace time.Duration) error {
+	_, err := supervisorCtl(m, i, "stop", fmt.Sprintf("-grace %s", grace))
+	if err != nil && supervisorDown(err) {
+		log.Printf("Instance %d on node %s: not running", i.ID, i.Hostname)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("Instance %d on node %s: stopped", i.ID, i.Hostname)
+	return nil
+}
@@ -0,0 +1,231 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/axelniklasson/plcli/lib/pl"
+	"github.com/axelniklasson/plcli/lib/util"
+)
+
+// healthEvent is emitted when a watched node changes state
+type healthEvent struct {
+	Time     time.Time `json:"time"`
+	Slice    string    `json:"slice"`
+	Hostname string    `json:"hostname"`
+	NodeID   int       `json:"node_id"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Score    float64   `json:"score"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// watchedNode is the latest known state of a node in watch mode
+type watchedNode struct {
+	Result              healthCheckResult
+	ConsecutiveFailures int
+	Since               time.Time
+}
+
+var webhookClient = &http.Client{Timeout: time.Second * 10}
+
+// postEvent posts a json encoded event to the given webhook url
+func postEvent(url string, event healthEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	res, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with status %s", res.Status)
+	}
+	return nil
+}
+
+// emitEvents writes events to stdout as ndjson if desired and posts them to the webhook if one is set
+func emitEvents(events []healthEvent, options *util.Options) {
+	encoder := json.NewEncoder(os.Stdout)
+	for _, e := range events {
+		if options.WatchOutput == "ndjson" {
+			encoder.Encode(e)
+		}
+		if options.Webhook != "" {
+			if err := postEvent(options.Webhook, e); err != nil {
+				log.Printf("Could not post event for node %s to webhook: %v", e.Hostname, err)
+			}
+		}
+	}
+}
+
+// renderWatchTable clears the terminal and prints the current state of all watched nodes
+func renderWatchTable(sliceName string, state map[string]*watchedNode, events []healthEvent, next time.Time) {
+	hostnames := []string{}
+	for hostname := range state {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+
+	fmt.Print("\033[H\033[2J")
+	fmt.Printf("Watching %d nodes of slice %s, next check at %s\n\n", len(state), sliceName, next.Format("15:04:05"))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOSTNAME\tSTATUS\tSCORE\tSSH RTT\tFAILURES\tSINCE\tREASON")
+	for _, hostname := range hostnames {
+		n := state[hostname]
+		fmt.Fprintf(w, "%s\t%s\t%.1f\t%s\t%d\t%s\t%s\n", hostname, healthStatus(n.Result.IsHealthy), n.Result.Score,
+			n.Result.SSHLatency.Round(time.Millisecond), n.ConsecutiveFailures, n.Since.Format("15:04:05"), n.Result.FailedCheck())
+	}
+	w.Flush()
+
+	if len(events) > 0 {
+		fmt.Println("\nChanges since last check:")
+		for _, e := range events {
+			fmt.Printf("%s %s: %s -> %s %s\n", e.Time.Format("15:04:05"), e.Hostname, e.From, e.To, e.Reason)
+		}
+	}
+}
+
+// removeNodesFromSlice detaches the nodes with the given hostnames from the slice, returning errors of the PL API
+// rather than exiting
+func removeNodesFromSlice(sliceName string, hostnames []string) error {
+	slices, err := pl.GetSlices(sliceName)
+	if err != nil {
+		return err
+	}
+	if len(slices) != 1 {
+		return fmt.Errorf("Expected exactly one slice matching %s, found %d", sliceName, len(slices))
+	}
+	nodes, err := pl.FetchNodesDetails(slices[0].NodeIDs)
+	if err != nil {
+		return err
+	}
+
+	remaining := []pl.Node{}
+	for _, n := range nodes {
+		remove := false
+		for _, hostname := range hostnames {
+			if n.HostName == hostname {
+				remove = true
+				break
+			}
+		}
+		if !remove {
+			remaining = append(remaining, n)
+		}
+	}
+
+	return pl.SetNodesForSlice(sliceName, remaining)
+}
+
+// HealthWatch continuously health checks all nodes attached to a slice and reports nodes changing state
+func HealthWatch(sliceName string, options *util.Options) error {
+	if options.WatchOutput != "table" && options.WatchOutput != "ndjson" {
+		return fmt.Errorf("Unknown output %s, should be table or ndjson", options.WatchOutput)
+	}
+
+	// logs would scroll the live table out of view, write them to a file in the data dir instead
+	if options.WatchOutput == "table" {
+		dir, err := util.DataDirPath()
+		if err != nil {
+			return err
+		}
+		logPath := fmt.Sprintf("%s/watch.log", dir)
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		fmt.Printf("Running first health check, logs are written to %s\n", logPath)
+		log.SetOutput(f)
+		defer log.SetOutput(os.Stderr)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	state := map[string]*watchedNode{}
+
+	for {
+		nodes, err := pl.GetNodesForSlice(sliceName)
+		if err != nil {
+			return err
+		}
+
+		// forget nodes that are no longer attached to the slice
+		attached := map[string]bool{}
+		for _, n := range nodes {
+			attached[n.HostName] = true
+		}
+		for hostname := range state {
+			if !attached[hostname] {
+				delete(state, hostname)
+			}
+		}
+
+		events := []healthEvent{}
+		toRemove := []string{}
+		// emitted only once the nodes are actually removed
+		removals := []healthEvent{}
+		for _, r := range checkNodes(sliceName, nodes) {
+			now := time.Now()
+			prev, exists := state[r.Node.HostName]
+			if !exists {
+				prev = &watchedNode{Result: r, Since: now}
+				state[r.Node.HostName] = prev
+			} else if prev.Result.IsHealthy != r.IsHealthy {
+				events = append(events, healthEvent{now, sliceName, r.Node.HostName, r.Node.NodeID,
+					healthStatus(prev.Result.IsHealthy), healthStatus(r.IsHealthy), r.Score, r.FailedCheck()})
+				prev.Since = now
+			}
+
+			prev.Result = r
+			if r.IsHealthy {
+				prev.ConsecutiveFailures = 0
+			} else {
+				prev.ConsecutiveFailures++
+			}
+
+			if options.RemoveAfter > 0 && prev.ConsecutiveFailures >= options.RemoveAfter {
+				toRemove = append(toRemove, r.Node.HostName)
+				removals = append(removals, healthEvent{now, sliceName, r.Node.HostName, r.Node.NodeID,
+					healthStatus(r.IsHealthy), "removed", r.Score, fmt.Sprintf("%d consecutive failures", prev.ConsecutiveFailures)})
+			}
+		}
+
+		if len(toRemove) > 0 {
+			if err := removeNodesFromSlice(sliceName, toRemove); err != nil {
+				log.Printf("Could not remove faulty nodes %v from slice, retrying after the next check: %v", toRemove, err)
+			} else {
+				for _, hostname := range toRemove {
+					delete(state, hostname)
+				}
+				events = append(events, removals...)
+			}
+		}
+
+		sleep := options.WatchInterval
+		if options.WatchJitter > 0 {
+			sleep += time.Duration(rand.Int63n(int64(options.WatchJitter)))
+		}
+
+		emitEvents(events, options)
+		if options.WatchOutput == "table" {
+			renderWatchTable(sliceName, state, events, time.Now().Add(sleep))
+		}
+
+		time.Sleep(sleep)
+	}
+}
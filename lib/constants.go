@@ -14,6 +14,9 @@ var (
 // ConfFile is the plcli conf file residing in users home dir
 const ConfFile = ".plcli"
 
+// DataDir is the directory in the users home dir where plcli keeps its local state
+const DataDir = ".plcli.d"
+
 // SSHPort is the port to use when connecting over ssh
 const SSHPort = 22
 
@@ -13,9 +13,8 @@ func GetSlices(sliceName string) ([]Slice, error) {
 	args[1] = sliceName
 
 	slices := []Slice{}
-	err := client.Call("GetSlices", args, &slices)
-	if err != nil {
-		log.Fatal(err)
+	if err := client.Call("GetSlices", args, &slices); err != nil {
+		return nil, err
 	}
 
 	return slices, nil
@@ -46,6 +45,16 @@ func GetNodeDetails(nodeID int) (Node, error) {
 
 // GetNodesDetails returns details about given nodes
 func GetNodesDetails(nodeIDs []int) []Node {
+	nodes, err := FetchNodesDetails(nodeIDs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return nodes
+}
+
+// FetchNodesDetails returns details about given nodes, or the error of the PL API
+func FetchNodesDetails(nodeIDs []int) ([]Node, error) {
 	log.Printf("Fetching details about nodes with IDs %v", nodeIDs)
 	client := GetClient()
 	args := make([]interface{}, 2)
@@ -53,7 +62,16 @@ func GetNodesDetails(nodeIDs []int) []Node {
 	args[1] = nodeIDs
 
 	nodes := []Node{}
-	err := client.Call("GetNodes", args, &nodes)
+	if err := client.Call("GetNodes", args, &nodes); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// GetAllNodes returns all nodes in the system
+func GetAllNodes() []Node {
+	nodes, err := FetchAllNodes()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -61,24 +79,51 @@ func GetNodesDetails(nodeIDs []int) []Node {
 	return nodes
 }
 
-// GetAllNodes returns all nodes in the system
-func GetAllNodes() []Node {
+// FetchAllNodes returns all nodes in the system, or the error of the PL API
+func FetchAllNodes() ([]Node, error) {
 	client := GetClient()
 	args := make([]interface{}, 2)
 	args[0] = GetClientAuth()
 
 	nodes := []Node{}
-	err := client.Call("GetNodes", args, &nodes)
+	if err := client.Call("GetNodes", args, &nodes); err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// GetSites returns details about the sites with the given IDs
+func GetSites(siteIDs []int) []Site {
+	sites, err := FetchSites(siteIDs)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	return nodes
+	return sites
+}
+
+// FetchSites returns details about the sites with the given IDs, or the error of the PL API
+func FetchSites(siteIDs []int) ([]Site, error) {
+	client := GetClient()
+	args := make([]interface{}, 2)
+	args[0] = GetClientAuth()
+	args[1] = siteIDs
+
+	sites := []Site{}
+	if err := client.Call("GetSites", args, &sites); err != nil {
+		return nil, err
+	}
+
+	return sites, nil
 }
 
 // GetNodeIDsForSlice returns the IDs of all nodes for a given slice
 func GetNodeIDsForSlice(sliceName string) []int {
-	slices, _ := GetSlices(sliceName)
+	slices, err := GetSlices(sliceName)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if len(slices) > 1 {
 		log.Fatal("Found more than one slice, please enter slice name correctly")
@@ -92,7 +137,10 @@ func GetNodeIDsForSlice(sliceName string) []int {
 // GetNodesForSlice fetches IDs of all attached nodes for the slice and then returns detailed
 // info about all of them
 func GetNodesForSlice(sliceName string) ([]Node, error) {
-	slices, _ := GetSlices(sliceName)
+	slices, err := GetSlices(sliceName)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if len(slices) > 1 {
 		log.Fatal("Found more than one slice, please enter slice name correctly")
@@ -108,7 +156,8 @@ func GetNodesForSlice(sliceName string) ([]Node, error) {
 	return detailedNodes, nil
 }
 
-// SetNodeIDsForSlice updates the field nodes of a given slice with the list of node ids
+// SetNodeIDsForSlice updates the field nodes of a given slice with the list of node ids, returning the error of
+// the PL API if that fails
 func SetNodeIDsForSlice(sliceName string, nodeIDs []int) error {
 	client := GetClient()
 	args := make([]interface{}, 3)
@@ -122,13 +171,12 @@ func SetNodeIDsForSlice(sliceName string, nodeIDs []int) error {
 	args[2] = nodeIDsArg
 
 	var res int
-	err := client.Call("UpdateSlice", args, &res)
-	if err != nil {
-		log.Fatal(err)
+	if err := client.Call("UpdateSlice", args, &res); err != nil {
+		return err
 	}
 
 	if res != 1 {
-		log.Fatalf("Something went wrong when updating nodes of slice %s", sliceName)
+		return fmt.Errorf("Something went wrong when updating nodes of slice %s", sliceName)
 	}
 
 	log.Printf("Updated nodes of slice %s to be %v", sliceName, nodeIDs)
@@ -55,3 +55,15 @@ type Node struct {
 	Model             string `xmlrpc:"model"`
 	Ports             []int  `xmlrpc:"ports"`
 }
+
+// Site models a PlanetLab site
+type Site struct {
+	SiteID      int     `xmlrpc:"site_id"`
+	Name        string  `xmlrpc:"name"`
+	LoginBase   string  `xmlrpc:"login_base"`
+	Abbreviated string  `xmlrpc:"abbreviated_name"`
+	URL         string  `xmlrpc:"url"`
+	Latitude    float64 `xmlrpc:"latitude"`
+	Longitude   float64 `xmlrpc:"longitude"`
+	NodeIDs     []int   `xmlrpc:"node_ids"`
+}
@@ -2,8 +2,9 @@
 # run as ./healthcheck [port] [response]
 # defaults to ./healthcheck 9876 OK
 
-# kill possible nc processes
-pkill -f nc
+# kill possible nc processes left by previous health checks
+pkill -x nc
+pkill -x ncat
 
 # check for Internet access
 wget -q --tries=10 --timeout=20 --spider https://images.ctfassets.net/2o3iq74rr1u2/6moBdVe2UwG0Fua6LTDQ6m/78cf10a8560cec2eb1009589ba6536f6/axel_profile_resized.jpg > /dev/null
@@ -0,0 +1,10 @@
+# runs DIR/run.sh and restarts it whenever it exits
+# usage: sh supervise.sh DIR
+echo $$ > "$1/supervisor.pid"
+cd "$1"
+
+while true; do
+	sh ./run.sh
+	echo "$(date) run.sh exited with status $?, restarting in 5s"
+	sleep 5
+done
@@ -0,0 +1,99 @@
+package supervisor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// rotatingWriter appends to a log file, which is rotated to path.1, path.2.. once it grows past maxSize. Only
+// maxFiles rotated files are kept, the log is truncated instead if maxFiles is 0. A maxSize of 0 disables rotation.
+type rotatingWriter struct {
+	mux      sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func newRotatingWriter(path string, maxSize int64, maxFiles int) (*rotatingWriter, error) {
+	w := &rotatingWriter{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// open opens the log for appending
+func (w *rotatingWriter) open() error {
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.f, w.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the log to path.1, shifting older rotated logs up and dropping the oldest, and opens a new log
+func (w *rotatingWriter) rotate() error {
+	w.f.Close()
+	if w.maxFiles > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", w.path, w.maxFiles))
+		for i := w.maxFiles - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", w.path, i), fmt.Sprintf("%s.%d", w.path, i+1))
+		}
+		if err := os.Rename(w.path, w.path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Truncate(w.path, 0); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.maxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.maxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// tail returns the last lines of the log
+func (w *rotatingWriter) tail(lines int) ([]string, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	data, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, err
+	}
+	all := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(data) == 0 {
+		return []string{}, nil
+	}
+	if lines > 0 && len(all) > lines {
+		all = all[len(all)-lines:]
+	}
+	return all, nil
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	return w.f.Close()
+}
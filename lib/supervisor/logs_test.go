@@ -0,0 +1,109 @@
+package supervisor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readLog returns the contents of a log file, or "" if it doesn't exist
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ""
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestRotatingWriterRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := newRotatingWriter(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := w.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the oldest rotated log is dropped once there are more than maxFiles
+	expected := map[string]string{path: "dddddddd\n", path + ".1": "cccccccc\n", path + ".2": "bbbbbbbb\n", path + ".3": ""}
+	for p, contents := range expected {
+		if got := readLog(t, p); got != contents {
+			t.Errorf("%s contains %q, expected %q", filepath.Base(p), got, contents)
+		}
+	}
+}
+
+func TestRotatingWriterTruncatesWithoutFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := newRotatingWriter(path, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	w.Write([]byte("aaaaaaaa\n"))
+	w.Write([]byte("bbbbbbbb\n"))
+	if got := readLog(t, path); got != "bbbbbbbb\n" {
+		t.Errorf("Log contains %q after truncating, expected the last line only", got)
+	}
+	if got := readLog(t, path+".1"); got != "" {
+		t.Errorf("Log was rotated to app.log.1 without rotated files being kept")
+	}
+}
+
+func TestRotatingWriterAppendsToExistingLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	if err := ioutil.WriteFile(path, []byte("aaaaaaaa\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := newRotatingWriter(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	// the size of the existing log counts towards rotation
+	w.Write([]byte("bbbbbbbb\n"))
+	if got := readLog(t, path+".1"); got != "aaaaaaaa\n" {
+		t.Errorf("app.log.1 contains %q, expected the existing log", got)
+	}
+}
+
+func TestRotatingWriterTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	w, err := newRotatingWriter(path, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if lines, err := w.tail(10); err != nil || len(lines) != 0 {
+		t.Errorf("tail of an empty log = %v, %v, expected no lines", lines, err)
+	}
+
+	w.Write([]byte("one\ntwo\nthree\n"))
+	tests := map[int][]string{
+		2:  {"two", "three"},
+		10: {"one", "two", "three"},
+		0:  {"one", "two", "three"},
+	}
+	for n, expected := range tests {
+		lines, err := w.tail(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("tail(%d) = %v, expected %v", n, lines, expected)
+		}
+	}
+}
@@ -0,0 +1,381 @@
+package supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// restart policies, deciding whether the process is started again after it exits
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// states of the supervised process
+const (
+	StateRunning = "running"
+	StateBackoff = "backoff"
+	StateExited  = "exited"
+	StateStopped = "stopped"
+)
+
+// a process that ran at least this long has its backoff reset when it exits
+var backoffReset = time.Minute
+
+// Config describes the process to supervise and how
+type Config struct {
+	Cmd         []string
+	Dir         string
+	Restart     string
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+	LogPath     string
+	MaxLogSize  int64
+	MaxLogFiles int
+	Socket      string
+}
+
+// Status is the state of the supervised process as reported over the control socket
+type Status struct {
+	State         string `json:"state"`
+	PID           int    `json:"pid,omitempty"`
+	UptimeSeconds int    `json:"uptime_seconds"`
+	Restarts      int    `json:"restarts"`
+	LastExit      string `json:"last_exit,omitempty"`
+}
+
+// Request is a command sent to the control socket, one of status, stop, restart and logs
+type Request struct {
+	Cmd   string        `json:"cmd"`
+	Grace time.Duration `json:"grace,omitempty"`
+	Lines int           `json:"lines,omitempty"`
+}
+
+// Response is the answer of the supervisor to a Request
+type Response struct {
+	Status *Status  `json:"status,omitempty"`
+	Logs   []string `json:"logs,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+// Supervisor runs a process in its own process group, restarts it according to its restart policy and writes its
+// output to a rotated log
+type Supervisor struct {
+	conf Config
+	log  *rotatingWriter
+
+	mux      sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	started  time.Time
+	state    string
+	restarts int
+	lastExit string
+	restart  bool
+	stopping bool
+
+	wake chan struct{}
+	done chan struct{}
+}
+
+// New creates a supervisor for conf, opening its log
+func New(conf Config) (*Supervisor, error) {
+	if len(conf.Cmd) == 0 {
+		return nil, errors.New("No command to supervise")
+	}
+	if conf.Restart != RestartNever && conf.Restart != RestartOnFailure && conf.Restart != RestartAlways {
+		return nil, fmt.Errorf("Unknown restart policy %s, should be never, on-failure or always", conf.Restart)
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = time.Second
+	}
+	if conf.MaxBackoff < conf.Backoff {
+		conf.MaxBackoff = conf.Backoff
+	}
+
+	w, err := newRotatingWriter(conf.LogPath, conf.MaxLogSize, conf.MaxLogFiles)
+	if err != nil {
+		return nil, err
+	}
+	return &Supervisor{conf: conf, log: w, state: StateStopped, wake: make(chan struct{}, 1), done: make(chan struct{})}, nil
+}
+
+// start starts the process, which has to be stopped
+func (s *Supervisor) start() error {
+	cmd := exec.Command(s.conf.Cmd[0], s.conf.Cmd[1:]...)
+	cmd.Dir = s.conf.Dir
+	cmd.Stdout = s.log
+	cmd.Stderr = s.log
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	s.cmd = cmd
+	s.exited = make(chan struct{})
+	s.started = time.Now()
+	s.state = StateRunning
+	return nil
+}
+
+// signal sends sig to the process group of the process, if it is running
+func (s *Supervisor) signal(sig syscall.Signal) {
+	if s.state == StateRunning && s.cmd != nil {
+		syscall.Kill(-s.cmd.Process.Pid, sig)
+	}
+}
+
+// terminate stops the running process with SIGTERM and SIGKILL after grace, waits for it to exit and returns
+// whether it was running
+func (s *Supervisor) terminate(grace time.Duration) bool {
+	s.mux.Lock()
+	if s.state != StateRunning {
+		s.mux.Unlock()
+		return false
+	}
+	exited := s.exited
+	s.signal(syscall.SIGTERM)
+	s.mux.Unlock()
+
+	select {
+	case <-exited:
+	case <-time.After(grace):
+		s.mux.Lock()
+		s.signal(syscall.SIGKILL)
+		s.mux.Unlock()
+		<-exited
+	}
+	return true
+}
+
+// status returns the current status of the process
+func (s *Supervisor) status() *Status {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	status := Status{State: s.state, Restarts: s.restarts, LastExit: s.lastExit}
+	if s.state == StateRunning {
+		status.PID = s.cmd.Process.Pid
+		status.UptimeSeconds = int(time.Since(s.started).Seconds())
+	}
+	return &status
+}
+
+// Stop stops the process and makes Run return
+func (s *Supervisor) Stop(grace time.Duration) {
+	s.mux.Lock()
+	if s.stopping {
+		s.mux.Unlock()
+		return
+	}
+	s.stopping = true
+	s.mux.Unlock()
+
+	s.terminate(grace)
+	close(s.done)
+}
+
+// Restart stops the process if it is running and starts it again right away, regardless of the restart policy
+func (s *Supervisor) Restart(grace time.Duration) {
+	s.mux.Lock()
+	s.restart = true
+	s.mux.Unlock()
+
+	// a running process is started again as soon as it exits, one that is down is woken up
+	if !s.terminate(grace) {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// nextBackoff returns how long to wait before starting a process again that exited after running for ran, -1 if it
+// stays down according to the restart policy, and the backoff to use after that. The backoff doubles on every
+// restart up to MaxBackoff, and starts over if the process ran for at least backoffReset.
+func (s *Supervisor) nextBackoff(backoff time.Duration, ran time.Duration, failed bool) (time.Duration, time.Duration) {
+	if s.conf.Restart == RestartNever || (s.conf.Restart == RestartOnFailure && !failed) {
+		// stays down until it is restarted over the control socket
+		return -1, backoff
+	}
+	if ran >= backoffReset {
+		backoff = s.conf.Backoff
+	}
+	next := backoff * 2
+	if next > s.conf.MaxBackoff {
+		next = s.conf.MaxBackoff
+	}
+	return backoff, next
+}
+
+// supervise runs the process until the supervisor is stopped
+func (s *Supervisor) supervise() {
+	backoff := s.conf.Backoff
+	for {
+		s.mux.Lock()
+		if s.stopping {
+			s.mux.Unlock()
+			return
+		}
+		err := s.start()
+		if err != nil {
+			s.lastExit = fmt.Sprintf("failed to start: %v", err)
+			s.state = StateExited
+		}
+		exited := s.exited
+		cmd := s.cmd
+		s.mux.Unlock()
+
+		failed := true
+		ran := time.Duration(0)
+		if err == nil {
+			err = cmd.Wait()
+			ran = time.Since(s.started)
+			failed = err != nil
+
+			s.mux.Lock()
+			s.state = StateExited
+			s.lastExit = "exit status 0"
+			if err != nil {
+				s.lastExit = err.Error()
+			}
+			close(exited)
+			s.mux.Unlock()
+		}
+		log.Printf("Process exited after %s: %s", ran.Round(time.Second), s.status().LastExit)
+
+		s.mux.Lock()
+		restart := s.restart
+		s.restart = false
+		if s.stopping {
+			s.state = StateStopped
+			s.mux.Unlock()
+			return
+		}
+		if restart {
+			backoff = s.conf.Backoff
+			s.mux.Unlock()
+			continue
+		}
+
+		var wait time.Duration
+		wait, backoff = s.nextBackoff(backoff, ran, failed)
+		if wait >= 0 {
+			s.state = StateBackoff
+		}
+		s.mux.Unlock()
+
+		var timeout <-chan time.Time
+		if wait >= 0 {
+			timeout = time.After(wait)
+		}
+		select {
+		case <-timeout:
+			s.mux.Lock()
+			s.restarts++
+			s.mux.Unlock()
+		case <-s.wake:
+			backoff = s.conf.Backoff
+			s.mux.Lock()
+			s.restart = false
+			s.mux.Unlock()
+		case <-s.done:
+			s.mux.Lock()
+			s.state = StateStopped
+			s.mux.Unlock()
+			return
+		}
+	}
+}
+
+// handle serves a single request on a connection to the control socket
+func (s *Supervisor) handle(conn net.Conn) {
+	defer conn.Close()
+
+	req := Request{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: fmt.Sprintf("malformed request: %v", err)})
+		return
+	}
+
+	resp := Response{}
+	switch req.Cmd {
+	case "status":
+		resp.Status = s.status()
+	case "stop":
+		s.Stop(req.Grace)
+		resp.Status = s.status()
+		resp.Status.State = StateStopped
+	case "restart":
+		s.Restart(req.Grace)
+		// give the process a moment to come up again before reporting its status
+		time.Sleep(time.Millisecond * 100)
+		resp.Status = s.status()
+	case "logs":
+		lines, err := s.log.tail(req.Lines)
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		resp.Logs = lines
+	default:
+		resp.Error = fmt.Sprintf("unknown command %s", req.Cmd)
+	}
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Run supervises the process and serves the control socket until the supervisor is stopped
+func (s *Supervisor) Run() error {
+	os.Remove(s.conf.Socket)
+	l, err := net.Listen("unix", s.conf.Socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(s.conf.Socket)
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.handle(conn)
+		}
+	}()
+
+	s.supervise()
+	// let a pending stop request get its response before the socket goes away
+	time.Sleep(time.Millisecond * 100)
+	return s.log.Close()
+}
+
+// Call sends a request to the control socket of a supervisor and returns its response
+func Call(socket string, req Request) (*Response, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second*5)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(req.Grace + time.Second*30))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, err
+	}
+	resp := Response{}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return &resp, errors.New(resp.Error)
+	}
+	return &resp, nil
+}
@@ -0,0 +1,240 @@
+package supervisor
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestSupervisor creates a supervisor for cmd with short backoffs and its log in a temp dir
+func newTestSupervisor(t *testing.T, restart string, backoff time.Duration, cmd ...string) *Supervisor {
+	dir := t.TempDir()
+	s, err := New(Config{
+		Cmd:        cmd,
+		Dir:        dir,
+		Restart:    restart,
+		Backoff:    backoff,
+		MaxBackoff: backoff * 4,
+		LogPath:    filepath.Join(dir, "app.log"),
+		Socket:     filepath.Join(dir, "supervisor.sock"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.log.Close() })
+	return s
+}
+
+// supervise runs supervise in the background and returns a channel that is closed once it returns
+func supervise(s *Supervisor) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		s.supervise()
+		close(done)
+	}()
+	return done
+}
+
+// waitFor polls the status of a supervisor until cond holds, failing the test after a few seconds
+func waitFor(t *testing.T, s *Supervisor, cond func(*Status) bool) *Status {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		status := s.status()
+		if cond(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for supervisor, last status %+v", status)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+// stop stops a supervisor and waits for supervise to return
+func stop(t *testing.T, s *Supervisor, done chan struct{}) {
+	t.Helper()
+	s.Stop(time.Second)
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("supervise did not return after stop")
+	}
+	if state := s.status().State; state != StateStopped {
+		t.Errorf("State after stop is %s, expected %s", state, StateStopped)
+	}
+}
+
+func TestNewRejectsUnknownPolicy(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := New(Config{Cmd: []string{"true"}, Restart: "sometimes", LogPath: filepath.Join(dir, "app.log")}); err == nil {
+		t.Error("Expected an error for an unknown restart policy")
+	}
+	if _, err := New(Config{Restart: RestartAlways, LogPath: filepath.Join(dir, "app.log")}); err == nil {
+		t.Error("Expected an error without a command")
+	}
+}
+
+func TestOnFailureRestartsFailedProcess(t *testing.T) {
+	s := newTestSupervisor(t, RestartOnFailure, time.Millisecond*10, "sh", "-c", "exit 1")
+	done := supervise(s)
+
+	status := waitFor(t, s, func(s *Status) bool { return s.Restarts >= 3 })
+	if status.LastExit != "exit status 1" {
+		t.Errorf("Last exit is %q, expected exit status 1", status.LastExit)
+	}
+	stop(t, s, done)
+}
+
+func TestOnFailureKeepsSucceededProcessDown(t *testing.T) {
+	s := newTestSupervisor(t, RestartOnFailure, time.Millisecond*10, "true")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.State == StateExited })
+	time.Sleep(time.Millisecond * 100)
+	status := s.status()
+	if status.State != StateExited || status.Restarts != 0 {
+		t.Errorf("Succeeded process was restarted, status %+v", status)
+	}
+	if status.LastExit != "exit status 0" {
+		t.Errorf("Last exit is %q, expected exit status 0", status.LastExit)
+	}
+	stop(t, s, done)
+}
+
+func TestAlwaysRestartsSucceededProcess(t *testing.T) {
+	s := newTestSupervisor(t, RestartAlways, time.Millisecond*10, "true")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.Restarts >= 3 })
+	stop(t, s, done)
+}
+
+func TestNeverKeepsFailedProcessDown(t *testing.T) {
+	s := newTestSupervisor(t, RestartNever, time.Millisecond*10, "sh", "-c", "exit 1")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.State == StateExited })
+	time.Sleep(time.Millisecond * 100)
+	status := s.status()
+	if status.State != StateExited || status.Restarts != 0 {
+		t.Errorf("Failed process was restarted, status %+v", status)
+	}
+	stop(t, s, done)
+}
+
+func TestStopDuringBackoff(t *testing.T) {
+	s := newTestSupervisor(t, RestartAlways, time.Hour, "true")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.State == StateBackoff })
+	start := time.Now()
+	stop(t, s, done)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stopping during backoff took %s", elapsed)
+	}
+	if restarts := s.status().Restarts; restarts != 0 {
+		t.Errorf("Process was restarted %d times after stop", restarts)
+	}
+}
+
+func TestStopRunningProcess(t *testing.T) {
+	s := newTestSupervisor(t, RestartAlways, time.Millisecond*10, "sleep", "10")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.State == StateRunning })
+	start := time.Now()
+	stop(t, s, done)
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Errorf("Stopping a running process took %s", elapsed)
+	}
+}
+
+func TestRestartRunningProcess(t *testing.T) {
+	s := newTestSupervisor(t, RestartNever, time.Millisecond*10, "sleep", "10")
+	done := supervise(s)
+
+	first := waitFor(t, s, func(s *Status) bool { return s.State == StateRunning })
+	s.Restart(time.Second)
+	// restarting ignores the never policy
+	waitFor(t, s, func(s *Status) bool { return s.State == StateRunning && s.PID != first.PID })
+	stop(t, s, done)
+}
+
+func TestRestartExitedProcess(t *testing.T) {
+	s := newTestSupervisor(t, RestartNever, time.Millisecond*10, "sh", "-c", "echo started")
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.State == StateExited })
+	s.Restart(time.Second)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		lines, err := s.log.tail(0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(lines) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Exited process was not started again, log %v", lines)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	stop(t, s, done)
+}
+
+func TestNextBackoff(t *testing.T) {
+	defer func(reset time.Duration) { backoffReset = reset }(backoffReset)
+	backoffReset = time.Minute
+
+	s := &Supervisor{conf: Config{Restart: RestartOnFailure, Backoff: time.Second, MaxBackoff: time.Second * 4}}
+	tests := []struct {
+		backoff time.Duration
+		ran     time.Duration
+		failed  bool
+		wait    time.Duration
+		next    time.Duration
+	}{
+		{time.Second, 0, true, time.Second, time.Second * 2},
+		{time.Second * 2, 0, true, time.Second * 2, time.Second * 4},
+		{time.Second * 4, 0, true, time.Second * 4, time.Second * 4},
+		// a process that ran long enough starts over with the initial backoff
+		{time.Second * 4, time.Minute, true, time.Second, time.Second * 2},
+		{time.Second * 4, time.Minute - time.Second, true, time.Second * 4, time.Second * 4},
+		{time.Second * 2, 0, false, -1, time.Second * 2},
+	}
+	for _, test := range tests {
+		wait, next := s.nextBackoff(test.backoff, test.ran, test.failed)
+		if wait != test.wait || next != test.next {
+			t.Errorf("nextBackoff(%s, %s, %v) = %s, %s, expected %s, %s", test.backoff, test.ran, test.failed, wait, next, test.wait, test.next)
+		}
+	}
+
+	s.conf.Restart = RestartNever
+	if wait, _ := s.nextBackoff(time.Second, 0, true); wait != -1 {
+		t.Errorf("never policy waits %s before restarting, expected it to stay down", wait)
+	}
+	s.conf.Restart = RestartAlways
+	if wait, _ := s.nextBackoff(time.Second, 0, false); wait != time.Second {
+		t.Errorf("always policy waits %s before restarting, expected 1s", wait)
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	defer func(reset time.Duration) { backoffReset = reset }(backoffReset)
+	backoffReset = time.Millisecond * 50
+
+	// every run outlasts backoffReset, so the process is restarted after the initial 100ms each time, where doubling
+	// backoffs would have waited 6.3s in total before the 6th restart
+	s := newTestSupervisor(t, RestartOnFailure, time.Millisecond*100, "sh", "-c", "sleep 0.1; exit 1")
+	s.conf.MaxBackoff = time.Hour
+	start := time.Now()
+	done := supervise(s)
+
+	waitFor(t, s, func(s *Status) bool { return s.Restarts >= 6 })
+	if elapsed := time.Since(start); elapsed > time.Second*3 {
+		t.Errorf("6 restarts took %s, backoff was not reset", elapsed)
+	}
+	stop(t, s, done)
+}
@@ -31,6 +31,21 @@ func ConfFilePath() (string, error) {
 	return fmt.Sprintf("%s/%s", homeDir, lib.ConfFile), nil
 }
 
+// DataDirPath returns the path for the ~/.plcli.d directory, creating it if it does not exist
+func DataDirPath() (string, error) {
+	homeDir, err := homedir.Dir()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get users home dir: %v", err)
+	}
+
+	path := fmt.Sprintf("%s/%s", homeDir, lib.DataDir)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
 // ConfFileExists returns bool indicating whether the conf file exists or not
 func ConfFileExists() (bool, error) {
 	path, err := ConfFilePath()
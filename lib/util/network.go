@@ -1,9 +1,9 @@
 package util
 
 import (
-	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -11,7 +11,7 @@ import (
 func PingHost(hostName string) error {
 	log.Printf("Pinging node %s\n", hostName)
 	timeout := time.Duration(1 * time.Second)
-	_, err := net.DialTimeout("tcp", fmt.Sprintf("%s:22", hostName), timeout)
+	_, err := net.DialTimeout("tcp", net.JoinHostPort(hostName, "22"), timeout)
 	if err != nil {
 		log.Println("Site unreachable, error: ", err)
 		return err
@@ -23,6 +23,6 @@ func PingHost(hostName string) error {
 // CheckPortOpen tries to connect to hostname:port over TCP and returns whether it succeeds or not
 func CheckPortOpen(hostName string, port int) error {
 	log.Printf("Checking if port %d on node %s is open", port, hostName)
-	_, err := net.Dial("tcp", fmt.Sprintf("%s:%d", hostName, port))
+	_, err := net.Dial("tcp", net.JoinHostPort(hostName, strconv.Itoa(port)))
 	return err
 }
@@ -1,5 +1,7 @@
 package util
 
+import "time"
+
 type Options struct {
 	Slice                string
 	NodeCount            int
@@ -12,9 +14,54 @@ type Options struct {
 	AppPath              string
 	PrometheusSDPath     string
 	NodeExporter         bool
+	NodeExporterVersion  string
+	NodeExporterSHA256   string
+	NodeExporterTarball  string
+	Addons               []string
 	ShuffleNodes         bool
 	SkipWriteHostsFile   bool
 	Sudo                 bool
 	BlacklistedHostnames string
-	EnvVars              string
+	EnvVars              []string
+	EnvFile              string
+	SortBy               string
+	MinReliability       float64
+	HealthWindow         string
+	WatchInterval        time.Duration
+	WatchJitter          time.Duration
+	WatchOutput          string
+	Webhook              string
+	RemoveAfter          int
+	Listen               string
+	ExporterInterval     time.Duration
+	MinReady             int
+	PropagationTimeout   time.Duration
+	PollInterval         time.Duration
+	BatchSize            int
+	TargetHealthy        int
+	MaxLastContact       time.Duration
+	CacheTTL             time.Duration
+	LogLines             int
+	List                 bool
+	Instances            string
+	GracePeriod          time.Duration
+	Strategy             string
+	RollbackOnFailure    bool
+	Deployment           string
+	Resume               bool
+	Spares               int
+	MinNodes             int
+	FromDir              string
+	FromArchive          string
+	RegistryInterval     time.Duration
+	PushPeers            bool
+	MonitorDir           string
+	Grafana              bool
+	ScrapeInterval       time.Duration
+	PrometheusURL        string
+	Follow               bool
+	Since                time.Duration
+	Grep                 string
+	CollectDir           string
+	Tarball              bool
 }
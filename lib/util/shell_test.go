@@ -0,0 +1,34 @@
+package util
+
+import (
+	"os/exec"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	tests := map[string]string{
+		"":            "''",
+		"plain":       "'plain'",
+		"two words":   "'two words'",
+		"it's":        `'it'\''s'`,
+		"$HOME `id`":  "'$HOME `id`'",
+		"a\"b\\c;d&e": "'a\"b\\c;d&e'",
+	}
+	for s, expected := range tests {
+		if got := ShellQuote(s); got != expected {
+			t.Errorf("ShellQuote(%q) = %s, expected %s", s, got, expected)
+		}
+	}
+}
+
+func TestShellQuoteRoundTrip(t *testing.T) {
+	for _, s := range []string{"", "it's", "$(echo no)", "'''", "line\nbreak", "*"} {
+		out, err := exec.Command("sh", "-c", "printf %s "+ShellQuote(s)).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != s {
+			t.Errorf("sh read %q back as %q", s, out)
+		}
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
@@ -57,11 +59,27 @@ func GetSession(sliceName string, hostname string) (*SSHConnection, error) {
 
 }
 
+// time to wait for the tcp connection and ssh handshake with a node, so that unreachable nodes don't hang callers
+const sshDialTimeout = time.Second * 30
+
+// the connection to the ssh agent, shared by all ssh connections rather than opening one per connection
+var (
+	agentClient agent.ExtendedAgent
+	agentMux    sync.Mutex
+)
+
 func sshAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
-		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
+	agentMux.Lock()
+	defer agentMux.Unlock()
+
+	if agentClient == nil {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil
+		}
+		agentClient = agent.NewClient(conn)
 	}
-	return nil
+	return ssh.PublicKeysCallback(agentClient.Signers)
 }
 
 // GetClientConfig returns the client config to use in SSH connections
@@ -72,5 +90,6 @@ func GetClientConfig(user string) *ssh.ClientConfig {
 			sshAgent(),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshDialTimeout,
 	}
 }
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/axelniklasson/plcli/lib"
 	"github.com/axelniklasson/plcli/lib/commands"
@@ -13,6 +14,23 @@ import (
 	"github.com/urfave/cli"
 )
 
+// instanceFlags returns the flags shared by commands that act on the instances of a deployment
+func instanceFlags(options *util.Options) []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:        "instances",
+			Usage:       "ID1,ID2,... string of instance IDs to act on, defaults to all instances",
+			Destination: &options.Instances,
+		},
+		&cli.DurationFlag{
+			Name:        "grace",
+			Value:       time.Second * 10,
+			Usage:       "time to wait for instances to exit after SIGTERM before sending SIGKILL",
+			Destination: &options.GracePeriod,
+		},
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "plcli"
@@ -124,36 +142,187 @@ func main() {
 		{
 			Name:      "health-check",
 			Usage:     "Performs a health check of all nodes attached to the slice and outputs healthy nodes",
-			UsageText: "plcli [--remove-faulty] health-check",
+			UsageText: "plcli health-check [--remove-faulty] [--sort-by score|hostname|ssh|cmd]",
 			Flags: []cli.Flag{
 				&cli.BoolFlag{
 					Name:        "remove-faulty",
 					Usage:       "remove faulty nodes from slice during healthcheck",
 					Destination: &options.RemoveFaulty,
 				},
-				&cli.BoolFlag{
-					Name:        "attach-to-slice",
-					Usage:       "attach all healthy nodes to slice",
-					Destination: &options.AttachToSlice,
+				&cli.StringFlag{
+					Name:        "sort-by",
+					Value:       "score",
+					Usage:       "how to sort the health report: score, hostname, ssh or cmd",
+					Destination: &options.SortBy,
 				},
 			},
 			Action: func(c *cli.Context) error {
-				commands.HealthCheck(options.Slice, options.RemoveFaulty)
+				commands.HealthCheck(options.Slice, options.RemoveFaulty, options.SortBy)
 				return nil
 			},
 		},
+		{
+			Name:  "health",
+			Usage: "Inspect the recorded health of nodes",
+			Subcommands: []cli.Command{
+				{
+					Name:      "history",
+					Usage:     "Lists recorded health checks for a node, or uptime and flap rates of all checked nodes",
+					UsageText: "plcli health history [--window 7d] [HOSTNAME]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "window",
+							Value:       "7d",
+							Usage:       "only consider health checks within this long ago, like 7d or 12h, 0 for all recorded checks",
+							Destination: &options.HealthWindow,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return commands.HealthHistory(c.Args().Get(0), options.HealthWindow)
+					},
+				},
+				{
+					Name:      "watch",
+					Usage:     "Continuously health checks all nodes attached to the slice and reports nodes changing state",
+					UsageText: "plcli health watch [--interval 5m] [--jitter 30s] [--output table|ndjson] [--webhook URL] [--remove-after N]",
+					Flags: []cli.Flag{
+						&cli.DurationFlag{
+							Name:        "interval",
+							Value:       time.Minute * 5,
+							Usage:       "time to wait between health checks",
+							Destination: &options.WatchInterval,
+						},
+						&cli.DurationFlag{
+							Name:        "jitter",
+							Value:       time.Second * 30,
+							Usage:       "maximum random time added to the interval",
+							Destination: &options.WatchJitter,
+						},
+						&cli.StringFlag{
+							Name:        "output",
+							Value:       "table",
+							Usage:       "table for a live table of node states or ndjson to write state changes to stdout",
+							Destination: &options.WatchOutput,
+						},
+						&cli.StringFlag{
+							Name:        "webhook",
+							Usage:       "if set, state changes are posted as json to this url",
+							Destination: &options.Webhook,
+						},
+						&cli.IntFlag{
+							Name:        "remove-after",
+							Usage:       "if set, nodes are removed from the slice after failing this many consecutive health checks",
+							Destination: &options.RemoveAfter,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return commands.HealthWatch(options.Slice, options)
+					},
+				},
+			},
+		},
+		{
+			Name:      "exporter",
+			Usage:     "Runs a Prometheus exporter exposing the health of the slice and its nodes",
+			UsageText: "plcli exporter [--listen :9200] [--interval 5m]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "listen",
+					Value:       ":9200",
+					Usage:       "address to expose metrics on",
+					Destination: &options.Listen,
+				},
+				&cli.DurationFlag{
+					Name:        "interval",
+					Value:       time.Minute * 5,
+					Usage:       "time to wait between health checks",
+					Destination: &options.ExporterInterval,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Exporter(options.Slice, options)
+			},
+		},
 		{
 			Name:      "discover-healthy",
 			Usage:     "Performs a health check of all nodes in the system and outputs hostnames and ids to an output file",
-			UsageText: "plcli [--attach-to-slice] discover-healthy",
+			UsageText: "plcli discover-healthy [--attach-to-slice] [--target N] [--batch-size N] [--min-ready N] [--propagation-timeout 30m]",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:        "attach-to-slice",
+					Usage:       "attach all healthy nodes to slice",
+					Destination: &options.AttachToSlice,
+				},
+				&cli.IntFlag{
+					Name:        "min-ready",
+					Usage:       "number of nodes per batch that must have the slice instantiated before health checking, defaults to all nodes that get it without stalling for 2 polls",
+					Destination: &options.MinReady,
+				},
+				&cli.DurationFlag{
+					Name:        "propagation-timeout",
+					Value:       time.Minute * 30,
+					Usage:       "maximum time to wait for the slice to be instantiated on nodes",
+					Destination: &options.PropagationTimeout,
+				},
+				&cli.DurationFlag{
+					Name:        "poll-interval",
+					Value:       time.Minute,
+					Usage:       "time to wait between checking if the slice has been instantiated on nodes",
+					Destination: &options.PollInterval,
+				},
+				&cli.IntFlag{
+					Name:        "batch-size",
+					Usage:       "number of nodes to attach and probe at a time, defaults to all candidate nodes at once",
+					Destination: &options.BatchSize,
+				},
+				&cli.IntFlag{
+					Name:        "target",
+					Usage:       "if set, discovery stops after the batch in which this many healthy nodes have been found",
+					Destination: &options.TargetHealthy,
+				},
+				&cli.DurationFlag{
+					Name:        "max-last-contact",
+					Value:       time.Hour * 24,
+					Usage:       "skip nodes that have not contacted PlanetLab within this time, 0 to disable",
+					Destination: &options.MaxLastContact,
+				},
+				&cli.DurationFlag{
+					Name:        "cache-ttl",
+					Value:       time.Hour,
+					Usage:       "skip nodes health checked within this time and reuse the result, 0 to disable",
+					Destination: &options.CacheTTL,
+				},
+			},
 			Action: func(c *cli.Context) error {
-				return commands.DiscoverHealthyNodes(options.Slice, options.AttachToSlice)
+				return commands.DiscoverHealthyNodes(options.Slice, options.AttachToSlice, options)
 			},
 		},
 		{
 			Name:      "deploy",
 			Usage:     "Deploys an application on PlanetLab nodes",
-			UsageText: "plcli deploy GIT_URL",
+			UsageText: "plcli deploy GIT_URL\n   plcli deploy --from-dir DIR | --from-archive APP.tar.gz\n   plcli deploy --strategy rolling [--batch-size N] [--rollback-on-failure] GIT_URL\n   plcli deploy validate [PATH|GIT_URL]",
+			Subcommands: []cli.Command{
+				{
+					Name:      "validate",
+					Usage:     "Checks a .plcli.yml file and reports its errors with line numbers",
+					UsageText: "plcli deploy validate [--git-branch BRANCH] [PATH|GIT_URL]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "git-branch",
+							Value:       "master",
+							Usage:       "what branch to check if a git url is given",
+							Destination: &options.GitBranch,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						target := c.Args().Get(0)
+						if target == "" {
+							target = "."
+						}
+						return commands.ValidateYML(target, options.GitBranch)
+					},
+				},
+			},
 			Flags: []cli.Flag{
 				&cli.IntFlag{
 					Name:        "node-count",
@@ -185,14 +354,34 @@ func main() {
 				},
 				&cli.StringFlag{
 					Name:        "prometheus-sd-path",
-					Usage:       "if present, plcli will generate sd.json for prometheus and write to supplied path",
+					Usage:       "if present, plcli will write a service discovery file for the deployment to supplied path, in the format set in .plcli.yml",
 					Destination: &options.PrometheusSDPath,
 				},
 				&cli.BoolFlag{
 					Name:        "node-exporter",
-					Usage:       "if set, node-exporter will be installed and launched on port 2100",
+					Usage:       "if set, the node_exporter addon will be installed under the slice home and kept running on port 2100",
 					Destination: &options.NodeExporter,
 				},
+				&cli.StringSliceFlag{
+					Name:  "addon",
+					Usage: "name of a built-in or user defined addon to install and run on every node, can be given multiple times",
+					Value: (*cli.StringSlice)(&options.Addons),
+				},
+				&cli.StringFlag{
+					Name:        "node-exporter-version",
+					Usage:       "node_exporter release to install, defaults to the version of the node_exporter addon",
+					Destination: &options.NodeExporterVersion,
+				},
+				&cli.StringFlag{
+					Name:        "node-exporter-sha256",
+					Usage:       "sha256 of the node_exporter release tarball, defaults to the checksum published with the release",
+					Destination: &options.NodeExporterSHA256,
+				},
+				&cli.StringFlag{
+					Name:        "node-exporter-tarball",
+					Usage:       "if present, this local node_exporter release tarball is uploaded to nodes instead of downloaded on them",
+					Destination: &options.NodeExporterTarball,
+				},
 				&cli.BoolFlag{
 					Name:        "shuffle-nodes",
 					Usage:       "if set, nodes form PL api will be shuffled prior to deployment",
@@ -208,10 +397,79 @@ func main() {
 					Usage:       "HOST1,HOST2,... string of hostnames to blacklist in the deployment",
 					Destination: &options.BlacklistedHostnames,
 				},
+				&cli.StringSliceFlag{
+					Name:  "env",
+					Usage: "KEY=VALUE env var to use in deployment, can be given multiple times",
+					Value: (*cli.StringSlice)(&options.EnvVars),
+				},
 				&cli.StringFlag{
-					Name:        "env",
-					Usage:       "VAR1=VAL1,VAR2=VAL2,... string of env vars to use in deployment",
-					Destination: &options.EnvVars,
+					Name:        "env-file",
+					Usage:       "file with a KEY=VALUE env var to use in deployment on each line, overridden by --env",
+					Destination: &options.EnvFile,
+				},
+				&cli.Float64Flag{
+					Name:        "min-reliability",
+					Usage:       "if set, nodes with a recorded reliability (0-1) below this value are excluded from the deployment",
+					Destination: &options.MinReliability,
+				},
+				&cli.StringFlag{
+					Name:        "reliability-window",
+					Value:       "7d",
+					Usage:       "only consider health checks within this long ago for --min-reliability, like 7d or 12h, 0 for all recorded checks",
+					Destination: &options.HealthWindow,
+				},
+				&cli.StringFlag{
+					Name:        "strategy",
+					Value:       "recreate",
+					Usage:       "recreate to bootstrap and launch on fresh nodes, rolling to update the nodes of an existing deployment in batches",
+					Destination: &options.Strategy,
+				},
+				&cli.StringFlag{
+					Name:        "deployment",
+					Usage:       "ID of the deployment to update in a rolling deployment or to resume, defaults to the latest completed deployment on the slice when updating and the latest deployment when resuming",
+					Destination: &options.Deployment,
+				},
+				&cli.IntFlag{
+					Name:        "batch-size",
+					Value:       1,
+					Usage:       "number of nodes to update at a time in a rolling deployment",
+					Destination: &options.BatchSize,
+				},
+				&cli.BoolFlag{
+					Name:        "rollback-on-failure",
+					Usage:       "if set, a failed deployment rolls back all touched nodes to the previous deployment",
+					Destination: &options.RollbackOnFailure,
+				},
+				&cli.StringFlag{
+					Name:        "from-dir",
+					Usage:       "deploy the app in this local directory instead of a git url, it is uploaded to the nodes as an archive",
+					Destination: &options.FromDir,
+				},
+				&cli.StringFlag{
+					Name:        "from-archive",
+					Usage:       "deploy the app in this local .tar.gz archive instead of a git url",
+					Destination: &options.FromArchive,
+				},
+				&cli.IntFlag{
+					Name:        "spares",
+					Usage:       "number of extra healthy nodes that may replace nodes that fail to bootstrap",
+					Destination: &options.Spares,
+				},
+				&cli.IntFlag{
+					Name:        "min-nodes",
+					Usage:       "smallest number of nodes to deploy to when nodes fail and no spares are left, defaults to --node-count",
+					Destination: &options.MinNodes,
+				},
+				&cli.BoolFlag{
+					Name:        "resume",
+					Usage:       "continue a failed deployment from where it stopped instead of starting a new one",
+					Destination: &options.Resume,
+				},
+				&cli.DurationFlag{
+					Name:        "grace",
+					Value:       time.Second * 10,
+					Usage:       "time to wait for instances to exit after SIGTERM before sending SIGKILL when updating nodes",
+					Destination: &options.GracePeriod,
 				},
 			},
 			Action: func(c *cli.Context) error {
@@ -220,15 +478,209 @@ func main() {
 			},
 		},
 		{
-			Name:      "provision",
-			Usage:     "Provisions node(s) using a provided script",
-			UsageText: "plcli provision PATH_TO_SCRIPT HOSTNAME|all|HOSTNAME1,HOSTNAME1",
+			Name:      "status",
+			Usage:     "Reports whether the app instances of a deployment are running",
+			UsageText: "plcli status [--lines N] [DEPLOYMENT_ID]\n   plcli status --list",
+			Flags: []cli.Flag{
+				&cli.IntFlag{
+					Name:        "lines",
+					Value:       5,
+					Usage:       "number of log lines to show per instance",
+					Destination: &options.LogLines,
+				},
+				&cli.BoolFlag{
+					Name:        "list",
+					Usage:       "list all recorded deployments",
+					Destination: &options.List,
+				},
+			},
 			Action: func(c *cli.Context) error {
-				if len(c.Args()) != 2 {
-					log.Fatal("Run as provision PATH_TO_SCRIPT HOSTNAME|HOSTNAME1,HOSTNAME1")
+				if options.List {
+					return commands.ListDeployments()
 				}
+				return commands.Status(c.Args().Get(0), options.LogLines)
+			},
+		},
+		{
+			Name:      "logs",
+			Usage:     "Prints the logs of the app instances of a deployment",
+			UsageText: "plcli logs [--instance ID1,ID2..] [--follow] [--since 10m] [--grep PATTERN] [--lines N] [DEPLOYMENT_ID]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "instance",
+					Usage:       "ID1,ID2,... string of instance IDs to show logs of, defaults to all instances",
+					Destination: &options.Instances,
+				},
+				&cli.BoolFlag{
+					Name:        "follow, f",
+					Usage:       "keep printing new log lines as they are written",
+					Destination: &options.Follow,
+				},
+				&cli.DurationFlag{
+					Name:        "since",
+					Usage:       "only show lines starting with a timestamp no older than this, and the lines following them",
+					Destination: &options.Since,
+				},
+				&cli.StringFlag{
+					Name:        "grep",
+					Usage:       "only show lines matching this regular expression",
+					Destination: &options.Grep,
+				},
+				&cli.IntFlag{
+					Name:        "lines",
+					Value:       20,
+					Usage:       "number of lines to read from the end of each log, 0 for the whole log, which is the default with --since or --grep",
+					Destination: &options.LogLines,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if !c.IsSet("lines") && (options.Since > 0 || options.Grep != "") {
+					options.LogLines = 0
+				}
+				return commands.Logs(c.Args().Get(0), options)
+			},
+		},
+		{
+			Name:      "collect",
+			Usage:     "Collects the logs and artifacts of a deployment from all of its nodes",
+			UsageText: "plcli collect [--dir ./runs] [--tarball] [--prometheus-sd-path PATH] [DEPLOYMENT_ID]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:        "dir",
+					Value:       "./runs",
+					Usage:       "directory to collect runs to, each deployment gets a directory named by its ID",
+					Destination: &options.CollectDir,
+				},
+				&cli.BoolFlag{
+					Name:        "tarball",
+					Usage:       "if set, the collected run is also packed into a gzipped tarball next to its directory",
+					Destination: &options.Tarball,
+				},
+				&cli.StringFlag{
+					Name:        "prometheus-sd-path",
+					Value:       "sd.json",
+					Usage:       "service discovery file of the deployment to include in the run, skipped if it doesn't exist",
+					Destination: &options.PrometheusSDPath,
+				},
+			},
+			Action: func(c *cli.Context) error {
+				return commands.Collect(c.Args().Get(0), options)
+			},
+		},
+		{
+			Name:      "stop",
+			Usage:     "Stops the app instances of a deployment",
+			UsageText: "plcli stop [--instances ID1,ID2..] [--grace 10s] [DEPLOYMENT_ID]",
+			Flags:     instanceFlags(options),
+			Action: func(c *cli.Context) error {
+				return commands.Stop(c.Args().Get(0), options.Instances, options.GracePeriod)
+			},
+		},
+		{
+			Name:      "restart",
+			Usage:     "Restarts the app instances of a deployment with the same instance IDs and env",
+			UsageText: "plcli restart [--instances ID1,ID2..] [--grace 10s] [DEPLOYMENT_ID]",
+			Flags:     instanceFlags(options),
+			Action: func(c *cli.Context) error {
+				return commands.Restart(c.Args().Get(0), options.Instances, options.GracePeriod)
+			},
+		},
+		{
+			Name:  "registry",
+			Usage: "Service discovery for the app instances of a deployment",
+			Subcommands: []cli.Command{
+				{
+					Name:      "serve",
+					Usage:     "Serves the instances of a deployment and their health as json over http",
+					UsageText: "plcli registry serve [--listen :9300] [--interval 30s] [--push-peers] [DEPLOYMENT_ID]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "listen",
+							Value:       ":9300",
+							Usage:       "address to serve instances on",
+							Destination: &options.Listen,
+						},
+						&cli.DurationFlag{
+							Name:        "interval",
+							Value:       time.Second * 30,
+							Usage:       "time to wait between checking the instances",
+							Destination: &options.RegistryInterval,
+						},
+						&cli.BoolFlag{
+							Name:        "push-peers",
+							Usage:       "if set, the peer list of healthy instances is written to all nodes whenever it changes",
+							Destination: &options.PushPeers,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return commands.RegistryServe(c.Args().Get(0), options)
+					},
+				},
+			},
+		},
+		{
+			Name:  "monitor",
+			Usage: "Sets up local monitoring of a deployment",
+			Subcommands: []cli.Command{
+				{
+					Name:      "up",
+					Usage:     "Writes a Prometheus config and optionally a Grafana dashboard for a deployment, ready to be mounted into containers",
+					UsageText: "plcli monitor up [--dir ./monitoring] [--prometheus-sd-path PATH] [--grafana] [DEPLOYMENT_ID]",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:        "dir",
+							Value:       "./monitoring",
+							Usage:       "directory to write the prometheus and grafana configs to",
+							Destination: &options.MonitorDir,
+						},
+						&cli.StringFlag{
+							Name:        "prometheus-sd-path",
+							Usage:       "if present, the sd file is written to this path instead of the prometheus dir and its dir is mounted into the prometheus container",
+							Destination: &options.PrometheusSDPath,
+						},
+						&cli.DurationFlag{
+							Name:        "scrape-interval",
+							Value:       time.Second * 15,
+							Usage:       "time between scrapes of every target",
+							Destination: &options.ScrapeInterval,
+						},
+						&cli.BoolFlag{
+							Name:        "grafana",
+							Usage:       "if set, a grafana datasource and a dashboard of the slice nodes are written as well",
+							Destination: &options.Grafana,
+						},
+						&cli.StringFlag{
+							Name:        "prometheus-url",
+							Value:       "http://localhost:9090",
+							Usage:       "url grafana reaches prometheus on",
+							Destination: &options.PrometheusURL,
+						},
+					},
+					Action: func(c *cli.Context) error {
+						return commands.MonitorUp(c.Args().Get(0), options)
+					},
+				},
+			},
+		},
+		{
+			Name:      "provision",
+			Usage:     "Provisions node(s) using a provided script and/or addons",
+			UsageText: "plcli provision [--addon NAME..] PATH_TO_SCRIPT HOSTNAME|all|HOSTNAME1,HOSTNAME1\n   plcli provision --addon NAME [--addon NAME..] HOSTNAME|all|HOSTNAME1,HOSTNAME1",
+			Flags: []cli.Flag{
+				&cli.StringSliceFlag{
+					Name:  "addon",
+					Usage: "name of a built-in or user defined addon to install and run on the nodes, can be given multiple times",
+					Value: (*cli.StringSlice)(&options.Addons),
+				},
+			},
+			Action: func(c *cli.Context) error {
 				provisionScriptPath := c.Args().Get(0)
 				hostnamesString := c.Args().Get(1)
+				if len(c.Args()) == 1 && len(options.Addons) > 0 {
+					provisionScriptPath, hostnamesString = "", c.Args().Get(0)
+				} else if len(c.Args()) != 2 {
+					log.Fatal("Run as provision PATH_TO_SCRIPT HOSTNAME|HOSTNAME1,HOSTNAME1")
+				}
 				var hostnames []string
 
 				if len(hostnamesString) == 0 {